@@ -32,6 +32,11 @@ func main() {
 
 	ks := keyschema.New(cfg.RedisKeyPrefix)
 	base := redisdao.NewRedisDao(client, ks)
+	metricBackend, err := redisdao.ParseMetricBackend(cfg.MetricBackend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	base.MetricBackend = metricBackend
 	siteDao := redisdao.NewSiteDao(base)
 	siteGeoDao := redisdao.NewSiteGeoDao(base)
 
@@ -61,21 +66,20 @@ func main() {
 		sites = append(sites, s)
 	}
 
-	// Load sites with pipeline
-	pipe := client.Pipeline()
+	// Load sites with pipeline, replacing the index entries of sites that
+	// were loaded before
 	fmt.Printf("Loading %d sites...\n", len(sites))
-	for _, site := range sites {
-		siteDao.InsertWithClient(ctx, site, pipe)
-		siteGeoDao.InsertWithClient(ctx, site, pipe)
-	}
-	if _, err := pipe.Exec(ctx); err != nil {
-		log.Fatalf("Failed to load sites: %v", err)
+	for i, err := range siteDao.InsertBatch(ctx, sites, siteDao.InsertWithClient, siteGeoDao.InsertWithClient) {
+		if err != nil {
+			log.Fatalf("Failed to load site %d: %v", sites[i].ID, err)
+		}
 	}
 	fmt.Println("Sites loaded.")
 
 	// Generate sample data
 	fmt.Println("Generating sample metrics data (1 day)...")
 	generator := datagen.NewSampleDataGenerator(client, sites, 1, ks)
+	generator.MetricBackend = metricBackend
 	fmt.Printf("Total readings to generate: %d\n", generator.Size())
 
 	p := client.Pipeline()
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/config"
+	redisdao "redisolar-go/internal/dao/redis"
+	"redisolar-go/internal/keyschema"
+	"redisolar-go/internal/models"
+)
+
+// migrate copies every site's metrics from one metric backend to the other.
+// The sorted set backend keeps minutes and two decimals, so measurements
+// copied out of it, or into it, are rounded to those.
+func main() {
+	from := flag.String("from", "", "metric backend to copy from (timeseries or zset)")
+	to := flag.String("to", "", "metric backend to copy to (timeseries or zset)")
+	days := flag.Int("days", 0, "how many days of metrics to copy (default: all the source backend keeps)")
+	flag.Parse()
+
+	if *from == "" || *to == "" {
+		log.Fatal("both -from and -to are required")
+	}
+	src, err := redisdao.ParseMetricBackend(*from)
+	if err != nil {
+		log.Fatalf("-from: %v", err)
+	}
+	dst, err := redisdao.ParseMetricBackend(*to)
+	if err != nil {
+		log.Fatalf("-to: %v", err)
+	}
+	if src == dst {
+		log.Fatalf("-from and -to are both %s", src)
+	}
+	if *days <= 0 {
+		*days = src.RetentionDays()
+	}
+
+	cfg := config.Load()
+	ctx := context.Background()
+
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     fmt.Sprintf("%s:%s", cfg.RedisHost, cfg.RedisPort),
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+	})
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+
+	ks := keyschema.New(cfg.RedisKeyPrefix)
+	srcBase := redisdao.NewRedisDao(client, ks)
+	srcBase.MetricBackend = src
+	dstBase := redisdao.NewRedisDao(client, ks)
+	dstBase.MetricBackend = dst
+	srcDao := redisdao.NewMetricStore(srcBase)
+	dstDao := redisdao.NewMetricStore(dstBase)
+
+	sites, err := redisdao.NewSiteDao(srcBase).FindAll(ctx)
+	if err != nil {
+		log.Fatalf("Failed to read sites: %v", err)
+	}
+
+	now := time.Now()
+	q := models.MetricRange{From: now.AddDate(0, 0, -*days), To: now}
+	// The destination would reject or drop anything older than it keeps.
+	if keep := dst.RetentionDays(); *days > keep {
+		fmt.Printf("%s keeps %d days of metrics, so only the last %d are copied.\n", dst, keep, keep)
+		*days = keep
+		q.From = now.AddDate(0, 0, -keep)
+	}
+	units := []models.MetricUnit{models.WHGenerated, models.WHUsed, models.TempCelsius}
+
+	fmt.Printf("Copying %d days of metrics for %d sites from %s to %s...\n", *days, len(sites), src, dst)
+	total := 0
+	for _, site := range sites {
+		if dst == redisdao.MetricBackendTimeseries {
+			// Create the labelled series and their compactions first, so
+			// the copied measurements are compacted too.
+			if err := redisdao.NewMetricTimeseriesDao(dstBase).CreateSeries(ctx, site); err != nil {
+				log.Fatalf("Failed to create series for site %d: %v", site.ID, err)
+			}
+		}
+		pipe := client.Pipeline()
+		count := 0
+		for _, unit := range units {
+			ms, err := srcDao.GetRange(ctx, site.ID, unit, q)
+			if err != nil {
+				log.Fatalf("Failed to read %s for site %d: %v", unit, site.ID, err)
+			}
+			for _, m := range ms {
+				dstDao.InsertMeasurementWithPipeline(ctx, m, pipe)
+			}
+			count += len(ms)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Fatalf("Failed to write metrics for site %d: %v", site.ID, err)
+		}
+		total += count
+	}
+	fmt.Printf("Copied %d measurements.\n", total)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/config"
+	redisdao "redisolar-go/internal/dao/redis"
+	"redisolar-go/internal/keyschema"
+)
+
+// reindex writes the secondary indexes and hash location field of every
+// registered site and, with the timeseries metric backend, creates or
+// relabels its series and their compactions. Sites written before these
+// existed are missing from filtered and sorted listings, geo searches and
+// fleet metrics until it has run once.
+func main() {
+	cfg := config.Load()
+	ctx := context.Background()
+
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     fmt.Sprintf("%s:%s", cfg.RedisHost, cfg.RedisPort),
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+	})
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+
+	ks := keyschema.New(cfg.RedisKeyPrefix)
+	base := redisdao.NewRedisDao(client, ks)
+	metricBackend, err := redisdao.ParseMetricBackend(cfg.MetricBackend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	base.MetricBackend = metricBackend
+
+	fmt.Println("Indexing sites...")
+	n, err := redisdao.NewSiteDao(base).Reindex(ctx)
+	if err != nil {
+		log.Fatalf("Failed to index sites: %v", err)
+	}
+	fmt.Printf("Indexed %d sites.\n", n)
+
+	if metricBackend != redisdao.MetricBackendTimeseries {
+		return
+	}
+	sites, err := redisdao.NewSiteDao(base).FindAll(ctx)
+	if err != nil {
+		log.Fatalf("Failed to read sites: %v", err)
+	}
+	fmt.Println("Creating site timeseries...")
+	if err := redisdao.NewMetricTimeseriesDao(base).CreateSeriesMany(ctx, sites); err != nil {
+		log.Fatalf("Failed to create series: %v", err)
+	}
+	fmt.Printf("Created or relabelled the series of %d sites.\n", len(sites))
+}
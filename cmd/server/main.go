@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	goredis "github.com/redis/go-redis/v9"
 
@@ -27,25 +29,67 @@ func main() {
 		Password: cfg.RedisPassword,
 	})
 
+	// Each streamed feed blocks one connection in XREAD, so those get a
+	// client of their own, with a connection per feed, and cannot starve
+	// the other requests.
+	if cfg.MaxFeedStreams <= 0 {
+		log.Fatalf("MAX_FEED_STREAMS must be positive, got %d", cfg.MaxFeedStreams)
+	}
+	streamClient := goredis.NewClient(&goredis.Options{
+		Addr:     fmt.Sprintf("%s:%s", cfg.RedisHost, cfg.RedisPort),
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+		PoolSize: cfg.MaxFeedStreams,
+	})
+
 	ks := keyschema.New(cfg.RedisKeyPrefix)
 	base := redisdao.NewRedisDao(client, ks)
+	metricBackend, err := redisdao.ParseMetricBackend(cfg.MetricBackend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	base.MetricBackend = metricBackend
+
+	meterReadingDao := redisdao.NewMeterReadingDao(base)
+	meterReadingDao.DeferStats = cfg.DeferStats
+
+	siteGeoDao := redisdao.NewSiteGeoDao(base)
+	siteGeoDao.ExcessCapacityThreshold = cfg.ExcessCapacity
+
+	siteSearchDao := redisdao.NewSiteSearchDao(base)
+	siteSearchDao.ExcessCapacityThreshold = cfg.ExcessCapacity
+	if cfg.UseSearchAPI {
+		if err := siteSearchDao.EnsureIndex(context.Background()); err != nil {
+			log.Printf("Site search index unavailable, searching without RediSearch: %v", err)
+		}
+	}
 
 	deps := api.Deps{
 		SiteDao:         redisdao.NewSiteDao(base),
-		SiteGeoDao:      redisdao.NewSiteGeoDao(base),
+		SiteGeoDao:      siteGeoDao,
+		SiteSearchDao:   siteSearchDao,
 		CapacityDao:     redisdao.NewCapacityReportDao(base),
-		MetricDao:       redisdao.NewMetricTimeseriesDao(base),
+		MetricDao:       redisdao.NewMetricStore(base),
 		FeedDao:         redisdao.NewFeedDao(base),
-		MeterReadingDao: redisdao.NewMeterReadingDao(base),
+		StreamFeedDao:   redisdao.NewFeedDao(redisdao.NewRedisDao(streamClient, ks)),
+		SiteStatsDao:    redisdao.NewSiteStatsDao(base),
+		IdempotencyDao:  redisdao.NewIdempotencyDao(base),
+		MeterReadingDao: meterReadingDao,
 		UseGeoSiteAPI:   cfg.UseGeoSiteAPI,
+		UseSearchAPI:    cfg.UseSearchAPI,
+		AtomicIngest:    cfg.AtomicIngest,
+		AsyncIngest:     cfg.AsyncIngest,
+		ReadingMaxSkew:  cfg.ReadingMaxSkew,
+		ReadingMaxAge:   time.Duration(metricBackend.RetentionDays()) * 24 * time.Hour,
+		MaxFeedStreams:  cfg.MaxFeedStreams,
 		StaticDir:       staticDir,
 	}
 
 	router := api.NewRouter(deps)
 
 	addr := ":" + cfg.ServerPort
-	log.Printf("Starting server on %s (geo=%v, prefix=%s, redis=%s:%s)",
-		addr, cfg.UseGeoSiteAPI, cfg.RedisKeyPrefix, cfg.RedisHost, cfg.RedisPort)
+	log.Printf("Starting server on %s (geo=%v, search=%v, atomic=%v, async=%v, metrics=%s, prefix=%s, redis=%s:%s)",
+		addr, cfg.UseGeoSiteAPI, cfg.UseSearchAPI, cfg.AtomicIngest, cfg.AsyncIngest, metricBackend, cfg.RedisKeyPrefix, cfg.RedisHost, cfg.RedisPort)
 	if err := http.ListenAndServe(addr, router); err != nil {
 		log.Fatal(err)
 	}
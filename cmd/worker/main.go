@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/config"
+	"redisolar-go/internal/dao"
+	redisdao "redisolar-go/internal/dao/redis"
+	"redisolar-go/internal/keyschema"
+	"redisolar-go/internal/models"
+	"redisolar-go/internal/processor"
+)
+
+const (
+	statsGroup  = "site-stats"
+	ingestGroup = "ingest"
+	feedGroup   = "feed"
+)
+
+// feedConsumers are handed every reading appended to the global feed, so
+// work such as alerts and exports runs off the POST /meter_readings path.
+// They share the feed consumer group, so an entry one of them fails is
+// handed to all of them again and each must tolerate seeing it twice.
+var feedConsumers []processor.Handler
+
+func main() {
+	cfg := config.Load()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     fmt.Sprintf("%s:%s", cfg.RedisHost, cfg.RedisPort),
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+	})
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+
+	ks := keyschema.New(cfg.RedisKeyPrefix)
+	base := redisdao.NewRedisDao(client, ks)
+	metricBackend, err := redisdao.ParseMetricBackend(cfg.MetricBackend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	base.MetricBackend = metricBackend
+
+	var processors []*processor.Processor
+
+	// Readings queued by a server running with ASYNC_INGEST.
+	if cfg.AsyncIngest {
+		meterReadingDao := redisdao.NewMeterReadingDao(base)
+		meterReadingDao.DeferStats = cfg.DeferStats
+		processors = append(processors, processor.New(client, processor.Config{
+			Stream:      ks.IngestStreamKey(),
+			Group:       ingestGroup,
+			StartID:     "0",
+			Consumer:    cfg.WorkerName,
+			DeadLetter:  ks.IngestDeadLetterKey(),
+			Workers:     cfg.WorkerCount,
+			ClaimIdle:   cfg.WorkerClaimIdle,
+			DeleteOnAck: true,
+		}, func(ctx context.Context, entry models.FeedEntry) error {
+			var err error
+			if cfg.AtomicIngest {
+				err = meterReadingDao.AddAtomic(ctx, []models.MeterReading{entry.Reading})[0]
+			} else {
+				err = meterReadingDao.Add(ctx, entry.Reading)
+			}
+			if err == dao.ErrDuplicateReading {
+				return nil
+			}
+			return err
+		}))
+	}
+
+	// Site stats, when the server runs with DEFER_STATS. The stats queue is
+	// not trimmed, so pending entries are never lost, and each entry is
+	// applied once however often it is delivered.
+	if cfg.DeferStats {
+		statsDao := redisdao.NewSiteStatsDao(base)
+		processors = append(processors, processor.New(client, processor.Config{
+			Stream:      ks.StatsQueueKey(),
+			Group:       statsGroup,
+			StartID:     "0",
+			Consumer:    cfg.WorkerName,
+			DeadLetter:  ks.StatsDeadLetterKey(),
+			Workers:     cfg.WorkerCount,
+			ClaimIdle:   cfg.WorkerClaimIdle,
+			DeleteOnAck: true,
+		}, func(ctx context.Context, entry models.FeedEntry) error {
+			return statsDao.ApplyOnce(ctx, entry.ID, entry.Reading)
+		}))
+	}
+
+	// The global feed. It is capped by length rather than drained, so
+	// entries are acknowledged but not deleted, and the group starts at
+	// the tail of the feed.
+	processors = append(processors, processor.New(client, processor.Config{
+		Stream:     ks.GlobalFeedKey(),
+		Group:      feedGroup,
+		Consumer:   cfg.WorkerName,
+		DeadLetter: ks.FeedDeadLetterKey(),
+		Workers:    cfg.WorkerCount,
+		ClaimIdle:  cfg.WorkerClaimIdle,
+	}, func(ctx context.Context, entry models.FeedEntry) error {
+		for _, consume := range feedConsumers {
+			if err := consume(ctx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	log.Printf("Starting worker %s (async=%v, stats=%v, feed consumers=%d, workers=%d, prefix=%s, redis=%s:%s)",
+		cfg.WorkerName, cfg.AsyncIngest, cfg.DeferStats, len(feedConsumers), cfg.WorkerCount, cfg.RedisKeyPrefix, cfg.RedisHost, cfg.RedisPort)
+
+	var wg sync.WaitGroup
+	for _, p := range processors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Run(ctx); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -1,6 +1,10 @@
 package api
 
-import "redisolar-go/internal/models"
+import (
+	"time"
+
+	"redisolar-go/internal/models"
+)
 
 // SiteResponse is the JSON response for a single site (nested coordinate).
 type SiteResponse struct {
@@ -38,6 +42,25 @@ func siteToResponse(s models.Site) SiteResponse {
 	return r
 }
 
+func responseToSite(r SiteResponse) models.Site {
+	s := models.Site{
+		ID:         r.ID,
+		Capacity:   r.Capacity,
+		Panels:     r.Panels,
+		Address:    r.Address,
+		City:       r.City,
+		State:      r.State,
+		PostalCode: r.PostalCode,
+	}
+	if r.Coordinate != nil {
+		s.Coordinate = &models.Coordinate{
+			Lng: r.Coordinate.Lng,
+			Lat: r.Coordinate.Lat,
+		}
+	}
+	return s
+}
+
 func sitesToResponse(sites []models.Site) []SiteResponse {
 	result := make([]SiteResponse, len(sites))
 	for i, s := range sites {
@@ -46,15 +69,130 @@ func sitesToResponse(sites []models.Site) []SiteResponse {
 	return result
 }
 
+// GeoSiteResponse is a site found by a geo query, with its distance from
+// the query point in the query's radius_unit.
+type GeoSiteResponse struct {
+	SiteResponse
+	Distance float64 `json:"distance"`
+}
+
+func geoSitesToResponse(sites []models.GeoSite) []GeoSiteResponse {
+	result := make([]GeoSiteResponse, len(sites))
+	for i, s := range sites {
+		result[i] = GeoSiteResponse{SiteResponse: siteToResponse(s.Site), Distance: s.Distance}
+	}
+	return result
+}
+
+// SiteClusterDTO is the aggregate of the sites in one geohash cell.
+type SiteClusterDTO struct {
+	GeoHash                string        `json:"geohash"`
+	Center                 CoordinateDTO `json:"center"`
+	Count                  int           `json:"count"`
+	TotalCapacity          float64       `json:"total_capacity"`
+	Reporting              int           `json:"reporting"`
+	AverageCurrentCapacity float64       `json:"average_current_capacity"`
+}
+
+func siteClustersToResponse(clusters []models.SiteCluster) []SiteClusterDTO {
+	result := make([]SiteClusterDTO, len(clusters))
+	for i, c := range clusters {
+		result[i] = SiteClusterDTO{
+			GeoHash:                c.GeoHash,
+			Center:                 CoordinateDTO{Lng: c.Center.Lng, Lat: c.Center.Lat},
+			Count:                  c.Count,
+			TotalCapacity:          c.TotalCapacity,
+			Reporting:              c.Reporting,
+			AverageCurrentCapacity: c.AverageCurrentCapacity,
+		}
+	}
+	return result
+}
+
+// SitesPage is a page of a filtered site listing. Pass NextCursor as cursor
+// to get the next page; it is omitted on the last page.
+type SitesPage struct {
+	Sites      []SiteResponse `json:"sites"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// SiteSearchResponse is a page of site search results and the total
+// number of matches.
+type SiteSearchResponse struct {
+	Total int64          `json:"total"`
+	Sites []SiteResponse `json:"sites"`
+}
+
+// SiteResultDTO reports the outcome for one site of a POST /sites request.
+type SiteResultDTO struct {
+	Index  int    `json:"index"`
+	ID     int    `json:"id"`
+	Status string `json:"status"` // created, updated or rejected
+	Reason string `json:"reason,omitempty"`
+}
+
+type SitesPostResponse struct {
+	Results []SiteResultDTO `json:"results"`
+}
+
 // CapacityTupleDTO is the JSON representation of a capacity tuple.
 type CapacityTupleDTO struct {
 	Capacity float64 `json:"capacity"`
 	SiteID   int     `json:"site_id"`
 }
 
+// CapacityReportResponse is the JSON representation of a capacity report.
+// From and To are set for reports over a past period.
 type CapacityReportResponse struct {
 	HighestCapacity []CapacityTupleDTO `json:"highest_capacity"`
 	LowestCapacity  []CapacityTupleDTO `json:"lowest_capacity"`
+	From            string             `json:"from,omitempty"`
+	To              string             `json:"to,omitempty"`
+}
+
+func (r CapacityReportResponse) withPeriod(from, to time.Time) CapacityReportResponse {
+	r.From = from.Format(time.RFC3339)
+	r.To = to.Format(time.RFC3339)
+	return r
+}
+
+// SiteCapacityRankResponse is the JSON representation of a site's place in
+// the capacity ranking.
+type SiteCapacityRankResponse struct {
+	SiteID     int                `json:"site_id"`
+	Rank       int64              `json:"rank"`
+	Capacity   float64            `json:"capacity"`
+	Percentile float64            `json:"percentile"`
+	Total      int64              `json:"total"`
+	Above      []CapacityTupleDTO `json:"above"`
+	Below      []CapacityTupleDTO `json:"below"`
+}
+
+func siteCapacityRankToResponse(r models.SiteCapacityRank) SiteCapacityRankResponse {
+	above := make([]CapacityTupleDTO, len(r.Above))
+	for i, t := range r.Above {
+		above[i] = CapacityTupleDTO{Capacity: t.Capacity, SiteID: t.SiteID}
+	}
+	below := make([]CapacityTupleDTO, len(r.Below))
+	for i, t := range r.Below {
+		below[i] = CapacityTupleDTO{Capacity: t.Capacity, SiteID: t.SiteID}
+	}
+	return SiteCapacityRankResponse{
+		SiteID:     r.SiteID,
+		Rank:       r.Rank,
+		Capacity:   r.Capacity,
+		Percentile: r.Percentile,
+		Total:      r.Total,
+		Above:      above,
+		Below:      below,
+	}
+}
+
+// CapacityCompareResponse puts a day's capacity report next to the day
+// before's.
+type CapacityCompareResponse struct {
+	Current  CapacityReportResponse `json:"current"`
+	Previous CapacityReportResponse `json:"previous"`
 }
 
 func capacityReportToResponse(r models.CapacityReport) CapacityReportResponse {
@@ -74,7 +212,16 @@ type MeterReadingsEnvelope struct {
 	Readings []MeterReadingDTO `json:"readings"`
 }
 
+// MeterReadingsPage is a page of a feed. Pass OldestID as before to get
+// the next older page, or NewestID as after to get newer readings.
+type MeterReadingsPage struct {
+	Readings []MeterReadingDTO `json:"readings"`
+	OldestID string            `json:"oldest_id,omitempty"`
+	NewestID string            `json:"newest_id,omitempty"`
+}
+
 type MeterReadingDTO struct {
+	ID          string  `json:"id,omitempty"`
 	SiteID      int     `json:"site_id"`
 	WHUsed      float64 `json:"wh_used"`
 	WHGenerated float64 `json:"wh_generated"`
@@ -100,6 +247,19 @@ func meterReadingsToDTO(readings []models.MeterReading) []MeterReadingDTO {
 	return result
 }
 
+func feedEntriesToPage(entries []models.FeedEntry) MeterReadingsPage {
+	page := MeterReadingsPage{Readings: make([]MeterReadingDTO, len(entries))}
+	for i, e := range entries {
+		page.Readings[i] = meterReadingToDTO(e.Reading)
+		page.Readings[i].ID = e.ID
+	}
+	if len(entries) > 0 {
+		page.NewestID = entries[0].ID
+		page.OldestID = entries[len(entries)-1].ID
+	}
+	return page
+}
+
 func dtoToMeterReading(dto MeterReadingDTO) models.MeterReading {
 	return models.MeterReading{
 		SiteID:      dto.SiteID,
@@ -110,6 +270,20 @@ func dtoToMeterReading(dto MeterReadingDTO) models.MeterReading {
 	}
 }
 
+// MeterReadingResultDTO reports the outcome for one reading of a POST batch.
+type MeterReadingResultDTO struct {
+	Index     int     `json:"index"`
+	SiteID    int     `json:"site_id"`
+	Timestamp float64 `json:"timestamp"`
+	Duplicate bool    `json:"duplicate,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+}
+
+type MeterReadingsPostResponse struct {
+	Accepted []MeterReadingResultDTO `json:"accepted"`
+	Rejected []MeterReadingResultDTO `json:"rejected"`
+}
+
 // MeasurementDTO is the JSON representation of a measurement.
 type MeasurementDTO struct {
 	SiteID     int     `json:"site_id"`
@@ -143,3 +317,73 @@ func plotToDTO(p models.Plot) PlotDTO {
 	}
 	return PlotDTO{Measurements: ms, Name: p.Name}
 }
+
+// FleetSeriesDTO is the JSON representation of a group's reduced
+// measurements. Group is empty for the whole fleet.
+type FleetSeriesDTO struct {
+	Group        string           `json:"group"`
+	Measurements []MeasurementDTO `json:"measurements"`
+}
+
+type FleetSeriesResponse struct {
+	Series []FleetSeriesDTO `json:"series"`
+}
+
+func fleetSeriesToResponse(series []models.FleetSeries) FleetSeriesResponse {
+	resp := FleetSeriesResponse{Series: make([]FleetSeriesDTO, len(series))}
+	for i, s := range series {
+		ms := make([]MeasurementDTO, len(s.Measurements))
+		for j, m := range s.Measurements {
+			ms[j] = measurementToDTO(m)
+		}
+		resp.Series[i] = FleetSeriesDTO{Group: s.Group, Measurements: ms}
+	}
+	return resp
+}
+
+// FleetValueDTO is the JSON representation of a group's reduced latest
+// value.
+type FleetValueDTO struct {
+	Group string  `json:"group"`
+	Value float64 `json:"value"`
+	Sites int     `json:"sites"`
+}
+
+type FleetValuesResponse struct {
+	Values []FleetValueDTO `json:"values"`
+}
+
+func fleetValuesToResponse(values []models.FleetValue) FleetValuesResponse {
+	resp := FleetValuesResponse{Values: make([]FleetValueDTO, len(values))}
+	for i, v := range values {
+		resp.Values[i] = FleetValueDTO{Group: v.Group, Value: v.Value, Sites: v.Sites}
+	}
+	return resp
+}
+
+// SiteStatsDTO is the JSON representation of a site's stats for one day.
+type SiteStatsDTO struct {
+	SiteID            int     `json:"site_id"`
+	Day               string  `json:"day"`
+	LastReportingTime string  `json:"last_reporting_time"`
+	MeterReadingCount int64   `json:"meter_reading_count"`
+	MaxWHGenerated    float64 `json:"max_wh_generated"`
+	MinWHGenerated    float64 `json:"min_wh_generated"`
+	MaxCapacity       float64 `json:"max_capacity"`
+}
+
+type SiteStatsRangeResponse struct {
+	Stats []SiteStatsDTO `json:"stats"`
+}
+
+func siteStatsToDTO(siteID int, day time.Time, s models.SiteStats) SiteStatsDTO {
+	return SiteStatsDTO{
+		SiteID:            siteID,
+		Day:               day.Format(statsDayLayout),
+		LastReportingTime: s.LastReportingTime,
+		MeterReadingCount: s.MeterReadingCount,
+		MaxWHGenerated:    s.MaxWHGenerated,
+		MinWHGenerated:    s.MinWHGenerated,
+		MaxCapacity:       s.MaxCapacity,
+	}
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	redisdao "redisolar-go/internal/dao/redis"
+	"redisolar-go/internal/models"
+)
+
+const (
+	feedReadBlock     = 5 * time.Second
+	feedReadCount     = 100
+	feedRetryDelay    = time.Second
+	feedKeepAlive     = 15 * time.Second
+	feedSubscriberBuf = 256
+	feedRetryAfter    = 10 * time.Second
+)
+
+// feedHub shares one blocking XREAD loop per feed stream among all the
+// clients streaming that feed, however many there are. Each loop holds a
+// connection for as long as it runs, so feedDao should have a client of its
+// own, and at most max feeds are streamed at once.
+type feedHub struct {
+	feedDao *redisdao.FeedDaoRedis
+	max     int
+
+	mu      sync.Mutex
+	streams map[string]*feedStream
+}
+
+type feedStream struct {
+	subs   map[chan models.FeedEntry]struct{}
+	cancel context.CancelFunc
+}
+
+// errTooManyFeeds is returned by subscribe when a new feed would exceed the
+// hub's limit of concurrently streamed feeds.
+var errTooManyFeeds = errors.New("too many feeds are being streamed, retry later")
+
+func newFeedHub(feedDao *redisdao.FeedDaoRedis, max int) *feedHub {
+	return &feedHub{feedDao: feedDao, max: max, streams: make(map[string]*feedStream)}
+}
+
+// subscribe registers a subscriber for new entries of the stream at key,
+// starting its reader if this is the first subscriber. The channel is
+// closed if the subscriber falls too far behind; call the returned
+// function to unsubscribe.
+func (h *feedHub) subscribe(key string) (<-chan models.FeedEntry, func(), error) {
+	ch := make(chan models.FeedEntry, feedSubscriberBuf)
+
+	h.mu.Lock()
+	stream, ok := h.streams[key]
+	if !ok {
+		if h.max > 0 && len(h.streams) >= h.max {
+			h.mu.Unlock()
+			return nil, nil, errTooManyFeeds
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = &feedStream{subs: make(map[chan models.FeedEntry]struct{}), cancel: cancel}
+		h.streams[key] = stream
+		go h.read(ctx, key, stream)
+	}
+	stream.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := stream.subs[ch]; ok {
+			delete(stream.subs, ch)
+			close(ch)
+		}
+		if len(stream.subs) == 0 && h.streams[key] == stream {
+			stream.cancel()
+			delete(h.streams, key)
+		}
+	}, nil
+}
+
+func (h *feedHub) read(ctx context.Context, key string, stream *feedStream) {
+	// Start from the current last ID rather than "$", so nothing added
+	// between two XREAD calls is missed.
+	lastID := ""
+	for ctx.Err() == nil {
+		if lastID == "" {
+			id, err := h.feedDao.LastID(ctx, key)
+			if err != nil {
+				h.retry(ctx, key, err)
+				continue
+			}
+			lastID = id
+		}
+
+		// lastID moves past messages that are not valid readings too, so
+		// a malformed entry is not read again on every call.
+		entries, next, err := h.feedDao.ReadAfter(ctx, key, lastID, feedReadCount, feedReadBlock)
+		if err != nil {
+			h.retry(ctx, key, err)
+			continue
+		}
+		lastID = next
+		if len(entries) == 0 {
+			continue
+		}
+
+		h.mu.Lock()
+		for ch := range stream.subs {
+			for _, entry := range entries {
+				select {
+				case ch <- entry:
+				default:
+					// Too slow: drop it and let the client resume
+					// from its Last-Event-ID.
+					delete(stream.subs, ch)
+					close(ch)
+				}
+				if _, ok := stream.subs[ch]; !ok {
+					break
+				}
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *feedHub) retry(ctx context.Context, key string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	log.Printf("reading feed %s: %v", key, err)
+	select {
+	case <-ctx.Done():
+	case <-time.After(feedRetryDelay):
+	}
+}
+
+// streamIDAfter reports whether stream entry ID a sorts after b.
+func streamIDAfter(a, b string) bool {
+	aMs, aSeq := parseStreamID(a)
+	bMs, bSeq := parseStreamID(b)
+	if aMs != bMs {
+		return aMs > bMs
+	}
+	return aSeq > bSeq
+}
+
+// isStreamID reports whether s looks like a stream entry ID ("ms" or "ms-seq").
+func isStreamID(s string) bool {
+	msStr, seqStr, hasSeq := strings.Cut(s, "-")
+	if _, err := strconv.ParseUint(msStr, 10, 64); err != nil {
+		return false
+	}
+	if hasSeq {
+		if _, err := strconv.ParseUint(seqStr, 10, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func parseStreamID(id string) (uint64, uint64) {
+	msStr, seqStr, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msStr, 10, 64)
+	seq, _ := strconv.ParseUint(seqStr, 10, 64)
+	return ms, seq
+}
+
+// feedStreamHandler streams new meter readings as Server-Sent Events, from
+// the global feed or, with ?site_id=N, from that site's feed. Each event's
+// id is the stream entry ID, so a reconnecting client resumes after the
+// last reading it saw via the Last-Event-ID header.
+func feedStreamHandler(feedDao *redisdao.FeedDaoRedis, hub *feedHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "streaming unsupported")
+			return
+		}
+
+		key := feedDao.KeySchema.GlobalFeedKey()
+		if s := r.URL.Query().Get("site_id"); s != "" {
+			siteID, err := strconv.Atoi(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid site_id")
+				return
+			}
+			key = feedDao.KeySchema.FeedKey(siteID)
+		}
+
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("last_event_id")
+		}
+		if lastID != "" && !isStreamID(lastID) {
+			writeError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+
+		// Subscribe before reading the backlog so nothing falls in between;
+		// entries seen in both are skipped by ID below.
+		entries, unsubscribe, err := hub.subscribe(key)
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(feedRetryAfter/time.Second)))
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		defer unsubscribe()
+
+		var backlog []models.FeedEntry
+		prev, cursor := lastID, lastID
+		if lastID != "" {
+			backlog, cursor, err = feedDao.RangeAfter(r.Context(), key, lastID, maxRecentFeeds)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		send := func(entry models.FeedEntry) error {
+			if lastID != "" && !streamIDAfter(entry.ID, lastID) {
+				return nil
+			}
+			dto := meterReadingToDTO(entry.Reading)
+			dto.ID = entry.ID
+			data, err := json.Marshal(dto)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: reading\ndata: %s\n\n", entry.ID, data); err != nil {
+				return err
+			}
+			lastID = entry.ID
+			return nil
+		}
+
+		// A client more than a page behind catches up a page at a time,
+		// until no entries are left between its last one and the live tail.
+		for cursor != prev {
+			for _, entry := range backlog {
+				if err := send(entry); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+			prev = cursor
+			backlog, cursor, err = feedDao.RangeAfter(r.Context(), key, prev, maxRecentFeeds)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(feedKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case entry, ok := <-entries:
+				if !ok {
+					return
+				}
+				if err := send(entry); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -1,9 +1,19 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"redisolar-go/internal/dao"
@@ -15,9 +25,18 @@ const (
 	defaultRecentFeeds = 100
 	maxRecentFeeds     = 1000
 	defaultMetricCount = 120
+	maxMetricPoints    = 10000
 	defaultCapLimit    = 10
+	defaultNeighbours  = 2
+	maxNeighbours      = 50
 	defaultRadius      = 10.0
 	defaultGeoUnit     = "km"
+	maxStatsDays       = 7 // site stats hashes expire after a week
+	statsDayLayout     = "2006-01-02"
+	idempotencyTTL     = 24 * time.Hour
+	idempotencyLease   = time.Minute // how long a request may hold its key
+	defaultSiteLimit   = 100
+	maxSiteLimit       = 1000
 )
 
 func getFeedCount(count int) int {
@@ -59,10 +78,127 @@ func extractIDFromPath(path string, prefix string) (int, bool) {
 	return id, true
 }
 
+// extractIDFromSubPath gets the site_id from a path like /sites/123/stats
+func extractIDFromSubPath(path string, prefix string, suffix string) (int, bool) {
+	path = strings.TrimSuffix(path, "/")
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(path[len(prefix) : len(path)-len(suffix)])
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
 // --- Site handlers ---
 
+// siteListParams are the query parameters that turn GET /sites into a
+// filtered, paginated listing.
+var siteListParams = []string{
+	"state", "city", "postal_code",
+	"min_capacity", "max_capacity", "min_panels", "max_panels",
+	"sort", "limit", "cursor",
+}
+
+// siteQueryFromRequest parses the listing parameters of r. ok is false if
+// none are present, in which case the plain list of all sites is returned.
+func siteQueryFromRequest(r *http.Request) (query models.SiteQuery, ok bool, err error) {
+	q := r.URL.Query()
+	for _, name := range siteListParams {
+		if q.Has(name) {
+			ok = true
+		}
+	}
+	if !ok {
+		return query, false, nil
+	}
+
+	query.State = q.Get("state")
+	query.City = q.Get("city")
+	query.PostalCode = q.Get("postal_code")
+	query.Cursor = q.Get("cursor")
+
+	for name, dst := range map[string]**float64{
+		"min_capacity": &query.MinCapacity,
+		"max_capacity": &query.MaxCapacity,
+	} {
+		if s := q.Get(name); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return query, true, fmt.Errorf("invalid %s", name)
+			}
+			*dst = &v
+		}
+	}
+	for name, dst := range map[string]**int{
+		"min_panels": &query.MinPanels,
+		"max_panels": &query.MaxPanels,
+	} {
+		if s := q.Get(name); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				return query, true, fmt.Errorf("invalid %s", name)
+			}
+			*dst = &v
+		}
+	}
+
+	sortBy := q.Get("sort")
+	if strings.HasPrefix(sortBy, "-") {
+		query.Descending = true
+		sortBy = sortBy[1:]
+	}
+	switch models.SiteSort(sortBy) {
+	case "", models.SiteSortID:
+		query.Sort = models.SiteSortID
+	case models.SiteSortCapacity:
+		query.Sort = models.SiteSortCapacity
+	default:
+		return query, true, fmt.Errorf("invalid sort, expected id or capacity")
+	}
+
+	query.Limit = defaultSiteLimit
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return query, true, fmt.Errorf("invalid limit")
+		}
+		if limit > maxSiteLimit {
+			limit = maxSiteLimit
+		}
+		query.Limit = limit
+	}
+	return query, true, nil
+}
+
+// writeSitesPage lists the sites matching query through list.
+func writeSitesPage(w http.ResponseWriter, r *http.Request, query models.SiteQuery,
+	list func(context.Context, models.SiteQuery) ([]models.Site, string, error)) {
+	sites, next, err := list(r.Context(), query)
+	if err == dao.ErrInvalidCursor {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, SitesPage{Sites: sitesToResponse(sites), NextCursor: next})
+}
+
 func siteListHandler(siteDao *redisdao.SiteDaoRedis) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		query, ok, err := siteQueryFromRequest(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if ok {
+			writeSitesPage(w, r, query, siteDao.List)
+			return
+		}
+
 		sites, err := siteDao.FindAll(r.Context())
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err.Error())
@@ -92,14 +228,150 @@ func siteByIDHandler(siteDao *redisdao.SiteDaoRedis) http.HandlerFunc {
 	}
 }
 
+// sitePostHandler registers or replaces one site (a JSON object) or many
+// (a JSON array), writing them to the site and geo indexes in one pipeline.
+func sitePostHandler(siteDao *redisdao.SiteDaoRedis, geoDao *redisdao.SiteGeoDaoRedis) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var raw json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+		var reqs []SiteResponse
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			if err := json.Unmarshal(trimmed, &reqs); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid JSON")
+				return
+			}
+		} else {
+			var req SiteResponse
+			if err := json.Unmarshal(trimmed, &req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid JSON")
+				return
+			}
+			reqs = []SiteResponse{req}
+		}
+
+		results := make([]SiteResultDTO, len(reqs))
+		var indexes []int
+		var sites []models.Site
+		for i, req := range reqs {
+			site := responseToSite(req)
+			results[i] = SiteResultDTO{Index: i, ID: site.ID}
+			if err := validateSite(site); err != nil {
+				results[i].Status = "rejected"
+				results[i].Reason = err.Error()
+				continue
+			}
+			indexes = append(indexes, i)
+			sites = append(sites, site)
+		}
+
+		ids := make([]int, len(sites))
+		for j, site := range sites {
+			ids[j] = site.ID
+		}
+		existed, err := siteDao.ExistsMany(r.Context(), ids...)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		rejected := len(reqs) - len(sites)
+		errs := siteDao.InsertBatch(r.Context(), sites, siteDao.InsertWithClient, geoDao.InsertWithClient)
+		for j, err := range errs {
+			result := &results[indexes[j]]
+			switch {
+			case err != nil:
+				result.Status = "rejected"
+				result.Reason = err.Error()
+				rejected++
+			case existed[j]:
+				result.Status = "updated"
+			default:
+				result.Status = "created"
+			}
+		}
+
+		status := http.StatusCreated
+		if rejected > 0 {
+			status = http.StatusMultiStatus
+		}
+		writeJSON(w, status, SitesPostResponse{Results: results})
+	}
+}
+
+func siteUpdateHandler(siteDao dao.SiteDao) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := extractIDFromPath(r.URL.Path, "/sites/")
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid site id")
+			return
+		}
+		var req SiteResponse
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+		req.ID = id
+		site := responseToSite(req)
+		if err := validateSite(site); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err := siteDao.Update(r.Context(), site)
+		if err == dao.ErrSiteNotFound {
+			writeError(w, http.StatusNotFound, "site not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, siteToResponse(site))
+	}
+}
+
+func siteDeleteHandler(siteDao dao.SiteDao) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := extractIDFromPath(r.URL.Path, "/sites/")
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid site id")
+			return
+		}
+		err := siteDao.Delete(r.Context(), id)
+		if err == dao.ErrSiteNotFound {
+			writeError(w, http.StatusNotFound, "site not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
 // --- Site Geo handlers ---
 
 func siteGeoListHandler(geoDao *redisdao.SiteGeoDaoRedis) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		latStr := r.URL.Query().Get("lat")
-		lngStr := r.URL.Query().Get("lng")
+		q := r.URL.Query()
+		hasPoint := q.Get("lat") != "" || q.Get("lng") != ""
+		hasBox := q.Get("min_lat") != "" || q.Get("min_lng") != "" ||
+			q.Get("max_lat") != "" || q.Get("max_lng") != ""
+
+		if !hasPoint && !hasBox {
+			query, ok, err := siteQueryFromRequest(r)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if ok {
+				writeSitesPage(w, r, query, geoDao.List)
+				return
+			}
 
-		if latStr == "" && lngStr == "" {
 			sites, err := geoDao.FindAll(r.Context())
 			if err != nil {
 				writeError(w, http.StatusInternalServerError, err.Error())
@@ -109,47 +381,265 @@ func siteGeoListHandler(geoDao *redisdao.SiteGeoDaoRedis) http.HandlerFunc {
 			return
 		}
 
-		if latStr == "" || lngStr == "" {
-			writeError(w, http.StatusNotFound, "both lat and lng required")
+		var query models.GeoQuery
+		if hasBox {
+			var err error
+			query, err = boundsQuery(r)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		} else {
+			if q.Get("lat") == "" || q.Get("lng") == "" {
+				writeError(w, http.StatusNotFound, "both lat and lng required")
+				return
+			}
+
+			lat, err := strconv.ParseFloat(q.Get("lat"), 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid lat")
+				return
+			}
+			lng, err := strconv.ParseFloat(q.Get("lng"), 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid lng")
+				return
+			}
+
+			radius := defaultRadius
+			if q.Get("radius") != "" {
+				radius, _ = strconv.ParseFloat(q.Get("radius"), 64)
+			}
+
+			radiusUnit := defaultGeoUnit
+			if q.Get("radius_unit") != "" {
+				radiusUnit = q.Get("radius_unit")
+			}
+
+			query = models.GeoQuery{
+				Coordinate: models.Coordinate{Lat: lat, Lng: lng},
+				Radius:     radius,
+				RadiusUnit: models.GeoUnit(radiusUnit),
+			}
+		}
+
+		if s := q.Get("count"); s != "" {
+			count, err := strconv.Atoi(s)
+			if err != nil || count <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid count")
+				return
+			}
+			query.Count = count
+		}
+		switch strings.ToUpper(q.Get("sort")) {
+		case "":
+		case string(models.GeoSortAsc):
+			query.Sort = models.GeoSortAsc
+		case string(models.GeoSortDesc):
+			query.Sort = models.GeoSortDesc
+		default:
+			writeError(w, http.StatusBadRequest, "invalid sort, expected asc or desc")
+			return
+		}
+		// Point searches list the nearest sites first.
+		if query.Sort == models.GeoSortNone && !hasBox {
+			query.Sort = models.GeoSortAsc
+		}
+		query.OnlyExcessCapacity = q.Get("only_excess_capacity") == "true"
+		for name, dst := range map[string]**float64{
+			"min_capacity": &query.MinCapacity,
+			"max_capacity": &query.MaxCapacity,
+		} {
+			if s := q.Get(name); s != "" {
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, "invalid "+name)
+					return
+				}
+				*dst = &v
+			}
+		}
+		switch metric := models.CapacityMetric(q.Get("capacity_metric")); metric {
+		case "", models.CapacityCurrent:
+			query.CapacityMetric = models.CapacityCurrent
+		case models.CapacityAverage:
+			query.CapacityMetric = models.CapacityAverage
+		default:
+			writeError(w, http.StatusBadRequest, "invalid capacity_metric, expected current or average")
 			return
 		}
 
-		lat, err := strconv.ParseFloat(latStr, 64)
+		sites, err := geoDao.FindNearby(r.Context(), query)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid lat")
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		lng, err := strconv.ParseFloat(lngStr, 64)
+		writeJSON(w, http.StatusOK, geoSitesToResponse(sites))
+	}
+}
+
+// boundsQuery builds a box query covering the viewport given by min_lat,
+// min_lng, max_lat and max_lng. The box is centred on the viewport and as
+// wide as its widest parallel, so no corner of the viewport is missed.
+func boundsQuery(r *http.Request) (models.GeoQuery, error) {
+	q := r.URL.Query()
+	var bounds [4]float64
+	for i, name := range []string{"min_lat", "min_lng", "max_lat", "max_lng"} {
+		v, err := strconv.ParseFloat(q.Get(name), 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, "invalid lng")
+			return models.GeoQuery{}, fmt.Errorf("invalid %s", name)
+		}
+		bounds[i] = v
+	}
+	minLat, minLng, maxLat, maxLng := bounds[0], bounds[1], bounds[2], bounds[3]
+	if minLat > maxLat || minLng > maxLng || minLat < -90 || maxLat > 90 || minLng < -180 || maxLng > 180 {
+		return models.GeoQuery{}, fmt.Errorf("invalid bounds")
+	}
+
+	center := models.Coordinate{Lat: (minLat + maxLat) / 2, Lng: (minLng + maxLng) / 2}
+	widestLat := 0.0
+	if minLat > 0 {
+		widestLat = minLat
+	} else if maxLat < 0 {
+		widestLat = maxLat
+	}
+	return models.GeoQuery{
+		Coordinate: center,
+		RadiusUnit: models.GeoUnitKM,
+		BoxWidth:   haversineKM(widestLat, minLng, widestLat, maxLng),
+		BoxHeight:  haversineKM(minLat, center.Lng, maxLat, center.Lng),
+	}, nil
+}
+
+// siteClustersHandler serves GET /sites/clusters: the sites in the
+// viewport given by min_lat, min_lng, max_lat and max_lng, aggregated per
+// geohash cell sized for the map zoom level.
+func siteClustersHandler(geoDao *redisdao.SiteGeoDaoRedis) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query, err := boundsQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		zoom, err := strconv.Atoi(r.URL.Query().Get("zoom"))
+		if err != nil || zoom < 0 {
+			writeError(w, http.StatusBadRequest, "invalid zoom")
 			return
 		}
 
-		radius := defaultRadius
-		if r.URL.Query().Get("radius") != "" {
-			radius, _ = strconv.ParseFloat(r.URL.Query().Get("radius"), 64)
+		clusters, err := geoDao.FindClusters(r.Context(), query, clusterPrecision(zoom))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
+		writeJSON(w, http.StatusOK, siteClustersToResponse(clusters))
+	}
+}
+
+// clusterPrecision maps a web map zoom level to a geohash length whose
+// cells are a few tens of pixels across: each extra character is roughly
+// two and a half zoom levels finer.
+func clusterPrecision(zoom int) int {
+	return zoom*2/5 + 1
+}
+
+// haversineKM returns the great-circle distance between two points in km,
+// using the same earth radius as Redis.
+func haversineKM(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKM = 6372.7976
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKM * math.Asin(math.Sqrt(a))
+}
+
+// siteSearchHandler serves GET /sites/search: free text in q matched
+// against address and city, optional min_capacity/max_capacity, and an
+// optional lat/lng with radius and radius_unit, paged by offset and limit.
+func siteSearchHandler(searchDao *redisdao.SiteSearchDaoRedis) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		search := models.SiteSearch{Text: q.Get("q"), Limit: defaultSiteLimit}
 
-		radiusUnit := defaultGeoUnit
-		if r.URL.Query().Get("radius_unit") != "" {
-			radiusUnit = r.URL.Query().Get("radius_unit")
+		for name, dst := range map[string]**float64{
+			"min_capacity": &search.MinCapacity,
+			"max_capacity": &search.MaxCapacity,
+		} {
+			if s := q.Get(name); s != "" {
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, "invalid "+name)
+					return
+				}
+				*dst = &v
+			}
 		}
 
-		onlyExcess := r.URL.Query().Get("only_excess_capacity") == "true"
+		latStr, lngStr := q.Get("lat"), q.Get("lng")
+		if latStr != "" || lngStr != "" {
+			lat, err := strconv.ParseFloat(latStr, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid lat")
+				return
+			}
+			lng, err := strconv.ParseFloat(lngStr, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid lng")
+				return
+			}
+			near := &models.GeoQuery{
+				Coordinate: models.Coordinate{Lat: lat, Lng: lng},
+				Radius:     defaultRadius,
+				RadiusUnit: models.GeoUnit(defaultGeoUnit),
+			}
+			if s := q.Get("radius"); s != "" {
+				radius, err := strconv.ParseFloat(s, 64)
+				if err != nil || radius <= 0 {
+					writeError(w, http.StatusBadRequest, "invalid radius")
+					return
+				}
+				near.Radius = radius
+			}
+			if s := q.Get("radius_unit"); s != "" {
+				switch unit := models.GeoUnit(s); unit {
+				case models.GeoUnitM, models.GeoUnitKM, models.GeoUnitMI, models.GeoUnitFT:
+					near.RadiusUnit = unit
+				default:
+					writeError(w, http.StatusBadRequest, "invalid radius_unit")
+					return
+				}
+			}
+			search.Near = near
+		}
 
-		query := models.GeoQuery{
-			Coordinate:         models.Coordinate{Lat: lat, Lng: lng},
-			Radius:             radius,
-			RadiusUnit:         models.GeoUnit(radiusUnit),
-			OnlyExcessCapacity: onlyExcess,
+		if s := q.Get("offset"); s != "" {
+			offset, err := strconv.Atoi(s)
+			if err != nil || offset < 0 {
+				writeError(w, http.StatusBadRequest, "invalid offset")
+				return
+			}
+			search.Offset = offset
+		}
+		if s := q.Get("limit"); s != "" {
+			limit, err := strconv.Atoi(s)
+			if err != nil || limit <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid limit")
+				return
+			}
+			if limit > maxSiteLimit {
+				limit = maxSiteLimit
+			}
+			search.Limit = limit
 		}
 
-		sites, err := geoDao.FindByGeo(r.Context(), query)
+		sites, total, err := searchDao.Search(r.Context(), search)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		writeJSON(w, http.StatusOK, sitesToResponse(sites))
+		writeJSON(w, http.StatusOK, SiteSearchResponse{Total: total, Sites: sitesToResponse(sites)})
 	}
 }
 
@@ -173,57 +663,439 @@ func siteGeoByIDHandler(geoDao *redisdao.SiteGeoDaoRedis) http.HandlerFunc {
 	}
 }
 
+// --- Site Stats handler ---
+
+func siteStatsHandler(statsDao *redisdao.SiteStatsDaoRedis) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := extractIDFromSubPath(r.URL.Path, "/sites/", "/stats")
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid site id")
+			return
+		}
+
+		day := time.Now()
+		if d := r.URL.Query().Get("date"); d != "" {
+			parsed, err := time.ParseInLocation(statsDayLayout, d, time.Local)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid date, expected YYYY-MM-DD")
+				return
+			}
+			day = parsed
+		}
+
+		daysStr := r.URL.Query().Get("days")
+		if daysStr == "" {
+			stats, err := statsDao.FindByID(r.Context(), id, day)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, siteStatsToDTO(id, day, stats))
+			return
+		}
+
+		n, err := strconv.Atoi(daysStr)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid days")
+			return
+		}
+		if n > maxStatsDays {
+			n = maxStatsDays
+		}
+
+		// Oldest day first, ending with the requested day.
+		days := make([]time.Time, n)
+		for i := range days {
+			days[i] = day.AddDate(0, 0, i-(n-1))
+		}
+		stats, err := statsDao.FindByDays(r.Context(), id, days)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp := SiteStatsRangeResponse{Stats: make([]SiteStatsDTO, len(stats))}
+		for i, s := range stats {
+			resp.Stats[i] = siteStatsToDTO(id, days[i], s)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
 // --- Capacity Report handler ---
 
+// capacityReportHandler serves the current capacity ranking, or with
+// at=<RFC3339 time or YYYY-MM-DD> the mean capacities for the UTC hour or
+// day containing it (bucket=hour|day picks which), with window=<duration>
+// the means over the last hours, and with compare=yesterday a day's means
+// next to the day before's.
 func capacityReportHandler(capDao *redisdao.CapacityReportDaoRedis) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
 		limit := defaultCapLimit
-		if l := r.URL.Query().Get("limit"); l != "" {
+		if l := q.Get("limit"); l != "" {
 			if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
 				limit = parsed
 			}
 		}
-		report, err := capDao.GetReport(r.Context(), limit)
+
+		at, window, compare := q.Get("at"), q.Get("window"), q.Get("compare")
+		if window != "" && (at != "" || compare != "") {
+			writeError(w, http.StatusBadRequest, "window cannot be combined with at or compare")
+			return
+		}
+
+		switch {
+		case compare != "":
+			if compare != "yesterday" {
+				writeError(w, http.StatusBadRequest, "invalid compare, expected yesterday")
+				return
+			}
+			day := time.Now()
+			if at != "" {
+				t, _, err := parseCapacityAt(at, string(models.CapacityBucketDay))
+				if err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				day = t
+			}
+			previousDay := day.AddDate(0, 0, -1)
+			current, err := capDao.GetReportAt(r.Context(), models.CapacityBucketDay, day, limit)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			previous, err := capDao.GetReportAt(r.Context(), models.CapacityBucketDay, previousDay, limit)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			from, to := capacityPeriod(models.CapacityBucketDay, day)
+			prevFrom, prevTo := capacityPeriod(models.CapacityBucketDay, previousDay)
+			writeJSON(w, http.StatusOK, CapacityCompareResponse{
+				Current:  capacityReportToResponse(current).withPeriod(from, to),
+				Previous: capacityReportToResponse(previous).withPeriod(prevFrom, prevTo),
+			})
+
+		case window != "":
+			d, err := time.ParseDuration(window)
+			if err != nil || d <= 0 || d > redisdao.CapacityHourRetention {
+				writeError(w, http.StatusBadRequest,
+					fmt.Sprintf("invalid window, expected a duration up to %s", redisdao.CapacityHourRetention))
+				return
+			}
+			now := time.Now()
+			report, err := capDao.GetReportWindow(r.Context(), d, now, limit)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			// The window covers whole hours, the current one included.
+			_, to := capacityPeriod(models.CapacityBucketHour, now)
+			from := to.Add(-(d + time.Hour - 1).Truncate(time.Hour))
+			writeJSON(w, http.StatusOK, capacityReportToResponse(report).withPeriod(from, to))
+
+		case at != "":
+			t, bucket, err := parseCapacityAt(at, q.Get("bucket"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			report, err := capDao.GetReportAt(r.Context(), bucket, t, limit)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			from, to := capacityPeriod(bucket, t)
+			writeJSON(w, http.StatusOK, capacityReportToResponse(report).withPeriod(from, to))
+
+		default:
+			report, err := capDao.GetReport(r.Context(), limit)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, capacityReportToResponse(report))
+		}
+	}
+}
+
+// siteCapacityRankHandler serves GET /capacity/{site_id}: the site's rank,
+// capacity and percentile among reporting sites, with up to neighbours
+// sites ranked on either side of it.
+func siteCapacityRankHandler(capDao *redisdao.CapacityReportDaoRedis) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := extractIDFromPath(r.URL.Path, "/capacity/")
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid site id")
+			return
+		}
+		neighbours := defaultNeighbours
+		if n := r.URL.Query().Get("neighbours"); n != "" {
+			parsed, err := strconv.Atoi(n)
+			if err != nil || parsed < 0 {
+				writeError(w, http.StatusBadRequest, "invalid neighbours")
+				return
+			}
+			neighbours = parsed
+		}
+		if neighbours > maxNeighbours {
+			neighbours = maxNeighbours
+		}
+
+		rank, err := capDao.GetSiteRank(r.Context(), id, neighbours)
+		if err == dao.ErrNoCapacity {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		writeJSON(w, http.StatusOK, capacityReportToResponse(report))
+		writeJSON(w, http.StatusOK, siteCapacityRankToResponse(rank))
+	}
+}
+
+// parseCapacityAt parses an RFC 3339 time, bucketed by hour unless bucket
+// says otherwise, or a YYYY-MM-DD date, taken as a UTC day.
+func parseCapacityAt(at, bucket string) (time.Time, models.CapacityBucket, error) {
+	t, err := time.Parse(time.RFC3339, at)
+	b := models.CapacityBucketHour
+	if err != nil {
+		t, err = time.ParseInLocation(statsDayLayout, at, time.UTC)
+		if err != nil {
+			return time.Time{}, "", fmt.Errorf("invalid at, expected an RFC 3339 time or YYYY-MM-DD")
+		}
+		b = models.CapacityBucketDay
 	}
+	switch models.CapacityBucket(bucket) {
+	case "":
+	case models.CapacityBucketHour, models.CapacityBucketDay:
+		b = models.CapacityBucket(bucket)
+	default:
+		return time.Time{}, "", fmt.Errorf("invalid bucket, expected hour or day")
+	}
+	return t, b, nil
+}
+
+// capacityPeriod returns the UTC hour or day containing t.
+func capacityPeriod(bucket models.CapacityBucket, t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	if bucket == models.CapacityBucketHour {
+		from := t.Truncate(time.Hour)
+		return from, from.Add(time.Hour)
+	}
+	from := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(0, 0, 1)
 }
 
 // --- Meter Reading handlers ---
 
-func meterReadingPostHandler(meterReadingDao *redisdao.MeterReadingDaoRedis) http.HandlerFunc {
+// ingestConfig holds the settings that control meterReadingPostHandler.
+type ingestConfig struct {
+	atomic  bool // write with the atomic ingest script
+	async   bool // only queue readings for the ingest worker
+	maxSkew time.Duration
+	maxAge  time.Duration // oldest reading the metric backend keeps
+}
+
+// storedResponse is what is kept under an Idempotency-Key so a retried
+// request gets back exactly what the first one did. While the first request
+// is in progress only Hash is set.
+type storedResponse struct {
+	Hash   string          `json:"hash"`
+	Status int             `json:"status,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+func meterReadingPostHandler(siteDao *redisdao.SiteDaoRedis, meterReadingDao *redisdao.MeterReadingDaoRedis, idempotencyDao *redisdao.IdempotencyDaoRedis, cfg ingestConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var envelope MeterReadingsEnvelope
-		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
-			writeError(w, http.StatusBadRequest, "invalid JSON")
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body")
 			return
 		}
-		for _, dto := range envelope.Readings {
-			reading := dtoToMeterReading(dto)
-			if err := meterReadingDao.Add(r.Context(), reading); err != nil {
+		sum := sha256.Sum256(payload)
+		hash := hex.EncodeToString(sum[:])
+
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		if idempotencyKey != "" {
+			reservation, _ := json.Marshal(storedResponse{Hash: hash})
+			reserved, err := idempotencyDao.Reserve(r.Context(), idempotencyKey, string(reservation), idempotencyLease)
+			if err != nil {
 				writeError(w, http.StatusInternalServerError, err.Error())
 				return
 			}
+			if !reserved {
+				replayIdempotent(w, r, idempotencyDao, idempotencyKey, hash)
+				return
+			}
+			// The reservation is released unless a response is saved over it.
+			defer func() {
+				if idempotencyKey != "" {
+					if err := idempotencyDao.Release(context.Background(), idempotencyKey); err != nil {
+						log.Printf("releasing idempotency key %q: %v", idempotencyKey, err)
+					}
+				}
+			}()
+		}
+
+		var envelope MeterReadingsEnvelope
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+
+		resp := MeterReadingsPostResponse{
+			Accepted: []MeterReadingResultDTO{},
+			Rejected: []MeterReadingResultDTO{},
+		}
+		reject := func(i int, reason string) {
+			dto := envelope.Readings[i]
+			resp.Rejected = append(resp.Rejected, MeterReadingResultDTO{
+				Index: i, SiteID: dto.SiteID, Timestamp: dto.Timestamp, Reason: reason,
+			})
+		}
+
+		siteIDs := make([]int, len(envelope.Readings))
+		for i, dto := range envelope.Readings {
+			siteIDs[i] = dto.SiteID
+		}
+		exists, err := siteDao.ExistsMany(r.Context(), siteIDs...)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		now := time.Now()
+		var indexes []int
+		var readings []models.MeterReading
+		for i, dto := range envelope.Readings {
+			if err := validateMeterReading(dto, now, cfg.maxSkew, cfg.maxAge); err != nil {
+				reject(i, err.Error())
+				continue
+			}
+			if !exists[i] {
+				reject(i, "unknown site_id")
+				continue
+			}
+			indexes = append(indexes, i)
+			readings = append(readings, dtoToMeterReading(dto))
 		}
-		writeJSON(w, http.StatusAccepted, "Accepted")
+
+		var errs []error
+		switch {
+		case cfg.async:
+			errs = make([]error, len(readings))
+			if err := meterReadingDao.Enqueue(r.Context(), readings); err != nil {
+				for i := range errs {
+					errs[i] = err
+				}
+			}
+		case cfg.atomic:
+			errs = meterReadingDao.AddAtomic(r.Context(), readings)
+		default:
+			errs = meterReadingDao.AddMany(r.Context(), readings)
+		}
+
+		failed := 0
+		for j, err := range errs {
+			i := indexes[j]
+			duplicate := err == dao.ErrDuplicateReading
+			if err != nil && !duplicate {
+				reject(i, err.Error())
+				failed++
+				continue
+			}
+			dto := envelope.Readings[i]
+			resp.Accepted = append(resp.Accepted, MeterReadingResultDTO{
+				Index: i, SiteID: dto.SiteID, Timestamp: dto.Timestamp, Duplicate: duplicate,
+			})
+		}
+
+		sort.Slice(resp.Rejected, func(a, b int) bool {
+			return resp.Rejected[a].Index < resp.Rejected[b].Index
+		})
+
+		status := http.StatusAccepted
+		if len(resp.Rejected) > 0 {
+			status = http.StatusMultiStatus
+		}
+		if failed > 0 && failed == len(readings) {
+			// Nothing could be written, so the response is not stored and a
+			// retry with the same Idempotency-Key is attempted again.
+			writeJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+		if idempotencyKey != "" {
+			body, _ := json.Marshal(resp)
+			stored, _ := json.Marshal(storedResponse{Hash: hash, Status: status, Body: body})
+			if err := idempotencyDao.Save(r.Context(), idempotencyKey, string(stored), idempotencyTTL); err != nil {
+				log.Printf("saving response for idempotency key %q: %v", idempotencyKey, err)
+			} else {
+				idempotencyKey = ""
+			}
+		}
+		writeJSON(w, status, resp)
 	}
 }
 
+// replayIdempotent answers a request whose Idempotency-Key is already
+// taken: with the stored response if the first request completed with the
+// same body, 409 if it is still in progress, and 422 if the key was used
+// for a different body.
+func replayIdempotent(w http.ResponseWriter, r *http.Request, idempotencyDao *redisdao.IdempotencyDaoRedis, key string, hash string) {
+	stored, found, err := idempotencyDao.Get(r.Context(), key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var prev storedResponse
+	if !found || json.Unmarshal([]byte(stored), &prev) != nil {
+		// The first request released the key in the meantime.
+		writeError(w, http.StatusConflict, "a request with this Idempotency-Key is in progress, retry later")
+		return
+	}
+	switch {
+	case prev.Hash != hash:
+		writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request body")
+	case prev.Status == 0:
+		writeError(w, http.StatusConflict, "a request with this Idempotency-Key is in progress, retry later")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(prev.Status)
+		w.Write(prev.Body)
+	}
+}
+
+// feedPageParams reads the count, before and after query parameters of the
+// feed endpoints.
+func feedPageParams(r *http.Request) (count int, before string, after string, ok bool) {
+	if c := r.URL.Query().Get("count"); c != "" {
+		count, _ = strconv.Atoi(c)
+	}
+	before = r.URL.Query().Get("before")
+	after = r.URL.Query().Get("after")
+	if (before != "" && !isStreamID(before)) || (after != "" && !isStreamID(after)) {
+		return 0, "", "", false
+	}
+	return getFeedCount(count), before, after, true
+}
+
 func globalFeedHandler(feedDao *redisdao.FeedDaoRedis) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		count := 0
-		if c := r.URL.Query().Get("count"); c != "" {
-			count, _ = strconv.Atoi(c)
+		count, before, after, ok := feedPageParams(r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
 		}
-		readings, err := feedDao.GetRecentGlobal(r.Context(), getFeedCount(count))
+		entries, err := feedDao.GetGlobalPage(r.Context(), before, after, count)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		writeJSON(w, http.StatusOK, MeterReadingsEnvelope{Readings: meterReadingsToDTO(readings)})
+		writeJSON(w, http.StatusOK, feedEntriesToPage(entries))
 	}
 }
 
@@ -234,22 +1106,23 @@ func siteFeedHandler(feedDao *redisdao.FeedDaoRedis) http.HandlerFunc {
 			writeError(w, http.StatusBadRequest, "invalid site id")
 			return
 		}
-		count := 0
-		if c := r.URL.Query().Get("count"); c != "" {
-			count, _ = strconv.Atoi(c)
+		count, before, after, ok := feedPageParams(r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
 		}
-		readings, err := feedDao.GetRecentForSite(r.Context(), id, getFeedCount(count))
+		entries, err := feedDao.GetSitePage(r.Context(), id, before, after, count)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		writeJSON(w, http.StatusOK, MeterReadingsEnvelope{Readings: meterReadingsToDTO(readings)})
+		writeJSON(w, http.StatusOK, feedEntriesToPage(entries))
 	}
 }
 
 // --- Metrics handler ---
 
-func metricsHandler(metricDao *redisdao.MetricDaoRedisTimeseries) http.HandlerFunc {
+func metricsHandler(metricDao dao.MetricDao) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, ok := extractIDFromPath(r.URL.Path, "/metrics/")
 		if !ok {
@@ -264,24 +1137,296 @@ func metricsHandler(metricDao *redisdao.MetricDaoRedisTimeseries) http.HandlerFu
 			}
 		}
 
+		units, err := metricUnitsFromRequest(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		q, ranged, err := metricRangeFromRequest(r, count)
+		if err == nil {
+			err = checkDerivedAggregation(units, q.Aggregation)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Stored units are read once each, even if net needs them too.
 		now := time.Now().UTC()
-		generated, err := metricDao.GetRecent(r.Context(), id, models.WHGenerated, now, count)
+		fetched := make(map[models.MetricUnit][]models.Measurement)
+		fetch := func(unit models.MetricUnit) ([]models.Measurement, error) {
+			if ms, ok := fetched[unit]; ok {
+				return ms, nil
+			}
+			var ms []models.Measurement
+			var err error
+			if ranged {
+				ms, err = metricDao.GetRange(r.Context(), id, unit, q)
+			} else {
+				ms, err = metricDao.GetRecent(r.Context(), id, unit, now, count)
+			}
+			fetched[unit] = ms
+			return ms, err
+		}
+
+		plots := PlotsResponse{Plots: make([]PlotDTO, 0, len(units))}
+		for _, unit := range units {
+			var ms []models.Measurement
+			switch unit {
+			case models.NetCapacity:
+				var generated, used []models.Measurement
+				generated, err = fetch(models.WHGenerated)
+				if err == nil {
+					used, err = fetch(models.WHUsed)
+				}
+				ms = models.NetCapacityMeasurements(generated, used)
+			case models.TempFahrenheit:
+				ms, err = fetch(models.TempCelsius)
+				ms = models.FahrenheitMeasurements(ms)
+			default:
+				ms, err = fetch(unit)
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			plots.Plots = append(plots.Plots, plotToDTO(models.Plot{Name: metricPlotNames[unit], Measurements: ms}))
+		}
+		writeJSON(w, http.StatusOK, plots)
+	}
+}
+
+// metricPlotNames are the plot names of the units GET /metrics/{id} serves.
+var metricPlotNames = map[models.MetricUnit]string{
+	models.WHGenerated:    "Watt-Hours Generated",
+	models.WHUsed:         "Watt-Hours Used",
+	models.TempCelsius:    "Temperature (°C)",
+	models.TempFahrenheit: "Temperature (°F)",
+	models.NetCapacity:    "Net Capacity (Wh)",
+}
+
+// metricUnitsFromRequest reads the comma-separated units parameter of GET
+// /metrics/{id}, defaulting to whG and whU. net is watt-hours generated
+// minus used, and temp_unit=F turns tempC into tempF.
+func metricUnitsFromRequest(r *http.Request) ([]models.MetricUnit, error) {
+	fahrenheit := false
+	switch strings.ToUpper(r.URL.Query().Get("temp_unit")) {
+	case "", "C":
+	case "F":
+		fahrenheit = true
+	default:
+		return nil, fmt.Errorf("invalid temp_unit, expected C or F")
+	}
+
+	param := r.URL.Query().Get("units")
+	if param == "" {
+		return []models.MetricUnit{models.WHGenerated, models.WHUsed}, nil
+	}
+	var units []models.MetricUnit
+	seen := make(map[models.MetricUnit]bool)
+	for _, name := range strings.Split(param, ",") {
+		unit := models.MetricUnit(strings.TrimSpace(name))
+		switch unit {
+		case models.WHGenerated, models.WHUsed, models.NetCapacity:
+		case models.TempCelsius:
+			if fahrenheit {
+				unit = models.TempFahrenheit
+			}
+		default:
+			return nil, fmt.Errorf("invalid unit %q, expected whG, whU, tempC or net", name)
+		}
+		if !seen[unit] {
+			seen[unit] = true
+			units = append(units, unit)
+		}
+	}
+	return units, nil
+}
+
+// checkDerivedAggregation rejects aggregations that give a wrong result for
+// units derived after aggregating: a sum of Fahrenheit temperatures adds the
+// 32° offset only once, and the minimum or maximum of net capacity would
+// subtract extremes from different minutes.
+func checkDerivedAggregation(units []models.MetricUnit, agg models.MetricAggregation) error {
+	for _, unit := range units {
+		switch {
+		case unit == models.TempFahrenheit && agg == models.MetricAggSum:
+			return fmt.Errorf("agg=sum is not supported for temp_unit=F")
+		case unit == models.NetCapacity && (agg == models.MetricAggMin || agg == models.MetricAggMax):
+			return fmt.Errorf("agg=%s is not supported for net, expected avg or sum", agg)
+		}
+	}
+	return nil
+}
+
+// fleetMetricsHandler serves GET /metrics/fleet: one unit's measurements
+// across every site, or those in a state or city, reduced per state, city
+// or for the whole fleet. It takes the range parameters of GET
+// /metrics/{id}, with a bucket of redisdao.DefaultFleetBucket if none is
+// given, or latest=true for each group's latest value.
+func fleetMetricsHandler(metricDao *redisdao.MetricDaoRedisTimeseries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		q := models.FleetQuery{
+			Unit:    models.WHGenerated,
+			State:   query.Get("state"),
+			City:    query.Get("city"),
+			GroupBy: models.FleetGroup(query.Get("group_by")),
+			Reduce:  models.MetricAggregation(query.Get("reduce")),
+		}
+		if unit := query.Get("unit"); unit != "" {
+			q.Unit = models.MetricUnit(unit)
+		}
+		switch q.Unit {
+		case models.WHGenerated, models.WHUsed, models.TempCelsius:
+		default:
+			writeError(w, http.StatusBadRequest, "invalid unit, expected whG, whU or tempC")
+			return
+		}
+		switch q.GroupBy {
+		case models.FleetGroupAll, models.FleetGroupState, models.FleetGroupCity:
+		default:
+			writeError(w, http.StatusBadRequest, "invalid group_by, expected state or city")
+			return
+		}
+		switch q.Reduce {
+		case "", models.MetricAggSum, models.MetricAggAvg, models.MetricAggMin, models.MetricAggMax:
+		default:
+			writeError(w, http.StatusBadRequest, "invalid reduce, expected sum, avg, min or max")
+			return
+		}
+
+		if query.Get("latest") == "true" {
+			values, err := metricDao.GetFleetLatest(r.Context(), q)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, fleetValuesToResponse(values))
+			return
+		}
+
+		count := defaultMetricCount
+		if c := query.Get("count"); c != "" {
+			if parsed, err := strconv.Atoi(c); err == nil && parsed > 0 {
+				count = parsed
+			}
+		}
+		rng, ranged, err := metricRangeFromRequest(r, count)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err.Error())
+			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		used, err := metricDao.GetRecent(r.Context(), id, models.WHUsed, now, count)
+		if !ranged {
+			if count > maxMetricPoints {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("count must be at most %d", maxMetricPoints))
+				return
+			}
+			now := time.Now().UTC()
+			rng = models.MetricRange{From: now.Add(-time.Duration(count) * time.Minute), To: now}
+		}
+		q.Range = rng
+
+		series, err := metricDao.GetFleetRange(r.Context(), q)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		writeJSON(w, http.StatusOK, fleetSeriesToResponse(series))
+	}
+}
 
-		plots := PlotsResponse{
-			Plots: []PlotDTO{
-				plotToDTO(models.Plot{Name: "Watt-Hours Generated", Measurements: generated}),
-				plotToDTO(models.Plot{Name: "Watt-Hours Used", Measurements: used}),
-			},
+// metricRangeFromRequest reads the from, to, bucket and agg parameters of
+// GET /metrics/{id}. ok is false if none is given, in which case the
+// latest count minutes are served. from and to take an RFC 3339 time or
+// Unix seconds; to defaults to now and from to count buckets before to.
+// bucket takes a duration such as 15m, 1h or 1d. A range of more than
+// maxMetricPoints buckets, or minutes without a bucket, is an error.
+func metricRangeFromRequest(r *http.Request, count int) (models.MetricRange, bool, error) {
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	bucket, agg := query.Get("bucket"), query.Get("agg")
+	if from == "" && to == "" && bucket == "" && agg == "" {
+		return models.MetricRange{}, false, nil
+	}
+
+	q := models.MetricRange{To: time.Now().UTC()}
+	if bucket != "" {
+		d, err := parseBucket(bucket)
+		if err != nil {
+			return q, true, err
 		}
-		writeJSON(w, http.StatusOK, plots)
+		q.Bucket = d
+	}
+	switch models.MetricAggregation(agg) {
+	case "":
+		if q.Bucket > 0 {
+			q.Aggregation = models.MetricAggAvg
+		}
+	case models.MetricAggAvg, models.MetricAggMin, models.MetricAggMax, models.MetricAggSum:
+		if q.Bucket == 0 {
+			return q, true, fmt.Errorf("agg requires bucket")
+		}
+		q.Aggregation = models.MetricAggregation(agg)
+	default:
+		return q, true, fmt.Errorf("invalid agg, expected avg, min, max or sum")
+	}
+
+	if to != "" {
+		t, err := parseMetricTime(to)
+		if err != nil {
+			return q, true, fmt.Errorf("invalid to: %v", err)
+		}
+		q.To = t
+	}
+	step := q.Bucket
+	if step == 0 {
+		step = time.Minute
+	}
+	q.From = q.To.Add(-time.Duration(count) * step)
+	if from != "" {
+		t, err := parseMetricTime(from)
+		if err != nil {
+			return q, true, fmt.Errorf("invalid from: %v", err)
+		}
+		q.From = t
+	}
+	if q.From.After(q.To) {
+		return q, true, fmt.Errorf("from must not be after to")
+	}
+	if points := q.To.Sub(q.From) / step; points > maxMetricPoints {
+		return q, true, fmt.Errorf("range spans %d points, more than %d; use a larger bucket or a shorter range",
+			points, maxMetricPoints)
+	}
+	return q, true, nil
+}
+
+// parseMetricTime parses an RFC 3339 time or Unix seconds.
+func parseMetricTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC 3339 time or Unix seconds")
+	}
+	return t, nil
+}
+
+// parseBucket parses a positive duration, also accepting whole days such
+// as 1d or 7d.
+func parseBucket(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d < time.Millisecond {
+		return 0, fmt.Errorf("invalid bucket, expected a duration such as 15m, 1h or 1d")
 	}
+	return d, nil
 }
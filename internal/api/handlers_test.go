@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"redisolar-go/internal/models"
+)
+
+func TestMetricRangeFromRequestPointCap(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{"from=0&to=600000", false},             // 10000 minutes
+		{"from=0&to=600060", true},              // 10001 minutes
+		{"from=0&to=36000000&bucket=1h", false}, // 10000 hours
+		{"from=0&to=36003600&bucket=1h", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/metrics/1?"+tt.query, nil)
+		_, ranged, err := metricRangeFromRequest(r, defaultMetricCount)
+		if !ranged {
+			t.Errorf("metricRangeFromRequest(%q) ranged = false, want true", tt.query)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("metricRangeFromRequest(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckDerivedAggregation(t *testing.T) {
+	tests := []struct {
+		unit    models.MetricUnit
+		agg     models.MetricAggregation
+		wantErr bool
+	}{
+		{models.TempFahrenheit, models.MetricAggAvg, false},
+		{models.TempFahrenheit, models.MetricAggMax, false},
+		{models.TempFahrenheit, models.MetricAggSum, true},
+		{models.NetCapacity, models.MetricAggSum, false},
+		{models.NetCapacity, models.MetricAggMin, true},
+		{models.NetCapacity, models.MetricAggMax, true},
+		{models.WHGenerated, models.MetricAggSum, false},
+	}
+	for _, tt := range tests {
+		err := checkDerivedAggregation([]models.MetricUnit{tt.unit}, tt.agg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkDerivedAggregation(%s, %s) error = %v, wantErr %v", tt.unit, tt.agg, err, tt.wantErr)
+		}
+	}
+}
@@ -2,18 +2,31 @@ package api
 
 import (
 	"net/http"
+	"strings"
+	"time"
 
+	"redisolar-go/internal/dao"
 	redisdao "redisolar-go/internal/dao/redis"
 )
 
 type Deps struct {
 	SiteDao         *redisdao.SiteDaoRedis
 	SiteGeoDao      *redisdao.SiteGeoDaoRedis
+	SiteSearchDao   *redisdao.SiteSearchDaoRedis
 	CapacityDao     *redisdao.CapacityReportDaoRedis
-	MetricDao       *redisdao.MetricDaoRedisTimeseries
+	MetricDao       dao.MetricDao
 	FeedDao         *redisdao.FeedDaoRedis
+	StreamFeedDao   *redisdao.FeedDaoRedis // for SSE feeds, on its own client
+	SiteStatsDao    *redisdao.SiteStatsDaoRedis
+	IdempotencyDao  *redisdao.IdempotencyDaoRedis
 	MeterReadingDao *redisdao.MeterReadingDaoRedis
 	UseGeoSiteAPI   bool
+	UseSearchAPI    bool
+	AtomicIngest    bool
+	AsyncIngest     bool
+	ReadingMaxSkew  time.Duration
+	ReadingMaxAge   time.Duration
+	MaxFeedStreams  int
 	StaticDir       string
 }
 
@@ -25,24 +38,78 @@ func NewRouter(deps Deps) http.Handler {
 	fs := http.StripPrefix("/static/", http.FileServer(http.Dir(deps.StaticDir)))
 	mux.Handle("/static/", fs)
 
-	// Sites routes - conditional on geo API
-	if deps.UseGeoSiteAPI {
-		mux.HandleFunc("/sites/", siteGeoByIDHandler(deps.SiteGeoDao))
-		mux.HandleFunc("/sites", siteGeoListHandler(deps.SiteGeoDao))
+	// Sites routes - conditional on search and geo API
+	var siteList, siteByID http.HandlerFunc
+	var siteDao dao.SiteDao
+	if deps.UseSearchAPI {
+		siteList = siteGeoListHandler(deps.SiteSearchDao.SiteGeoDaoRedis)
+		siteByID = siteGeoByIDHandler(deps.SiteSearchDao.SiteGeoDaoRedis)
+		siteDao = deps.SiteSearchDao
+		mux.HandleFunc("/sites/search", siteSearchHandler(deps.SiteSearchDao))
+	} else if deps.UseGeoSiteAPI {
+		siteList = siteGeoListHandler(deps.SiteGeoDao)
+		siteByID = siteGeoByIDHandler(deps.SiteGeoDao)
+		siteDao = deps.SiteGeoDao
 	} else {
-		mux.HandleFunc("/sites/", siteByIDHandler(deps.SiteDao))
-		mux.HandleFunc("/sites", siteListHandler(deps.SiteDao))
+		siteList = siteListHandler(deps.SiteDao)
+		siteByID = siteByIDHandler(deps.SiteDao)
+		siteDao = deps.SiteDao
 	}
+	sitePost := sitePostHandler(deps.SiteDao, deps.SiteGeoDao)
+	mux.HandleFunc("/sites", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			siteList(w, r)
+		case http.MethodPost:
+			sitePost(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/sites/clusters", siteClustersHandler(deps.SiteGeoDao))
+	siteUpdate := siteUpdateHandler(siteDao)
+	siteDelete := siteDeleteHandler(siteDao)
+	siteStats := siteStatsHandler(deps.SiteStatsDao)
+	mux.HandleFunc("/sites/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/stats") {
+			siteStats(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			siteByID(w, r)
+		case http.MethodPut:
+			siteUpdate(w, r)
+		case http.MethodDelete:
+			siteDelete(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 
 	// Capacity
 	mux.HandleFunc("/capacity", capacityReportHandler(deps.CapacityDao))
+	mux.HandleFunc("/capacity/", siteCapacityRankHandler(deps.CapacityDao))
 
 	// Meter readings - need to distinguish between POST, GET, and GET with ID
-	mux.HandleFunc("/meter_readings/", siteFeedHandler(deps.FeedDao))
+	ingest := ingestConfig{atomic: deps.AtomicIngest, async: deps.AsyncIngest, maxSkew: deps.ReadingMaxSkew, maxAge: deps.ReadingMaxAge}
+	siteFeed := siteFeedHandler(deps.FeedDao)
+	streamFeedDao := deps.StreamFeedDao
+	if streamFeedDao == nil {
+		streamFeedDao = deps.FeedDao
+	}
+	feedStream := feedStreamHandler(deps.FeedDao, newFeedHub(streamFeedDao, deps.MaxFeedStreams))
+	mux.HandleFunc("/meter_readings/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimSuffix(r.URL.Path, "/") == "/meter_readings/stream" {
+			feedStream(w, r)
+			return
+		}
+		siteFeed(w, r)
+	})
 	mux.HandleFunc("/meter_readings", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
-			meterReadingPostHandler(deps.MeterReadingDao)(w, r)
+			meterReadingPostHandler(deps.SiteDao, deps.MeterReadingDao, deps.IdempotencyDao, ingest)(w, r)
 		case http.MethodGet:
 			globalFeedHandler(deps.FeedDao)(w, r)
 		default:
@@ -52,6 +119,14 @@ func NewRouter(deps Deps) http.Handler {
 
 	// Metrics
 	mux.HandleFunc("/metrics/", metricsHandler(deps.MetricDao))
+	// Fleet queries need TS.MRANGE, so only the timeseries backend has them.
+	if tsDao, ok := deps.MetricDao.(*redisdao.MetricDaoRedisTimeseries); ok {
+		mux.HandleFunc("/metrics/fleet", fleetMetricsHandler(tsDao))
+	} else {
+		mux.HandleFunc("/metrics/fleet", func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, http.StatusNotImplemented, "fleet metrics need the timeseries metric backend")
+		})
+	}
 
 	// Root serves index.html
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"redisolar-go/internal/models"
+)
+
+var postalCodePattern = regexp.MustCompile(`^[0-9]{5}(-[0-9]{4})?$`)
+
+// maxGeoLat is the furthest latitude from the equator GEOADD accepts.
+const maxGeoLat = 85.05112878
+
+// validateMeterReading checks the fields of a reading that can be verified
+// without Redis. Site existence is checked separately for the whole batch.
+// Readings more than maxAge old, which the metric backend no longer keeps,
+// are rejected when maxAge is set.
+func validateMeterReading(dto MeterReadingDTO, now time.Time, maxSkew, maxAge time.Duration) error {
+	if dto.SiteID <= 0 {
+		return errors.New("site_id must be positive")
+	}
+	values := []struct {
+		name  string
+		value float64
+	}{
+		{"wh_used", dto.WHUsed},
+		{"wh_generated", dto.WHGenerated},
+		{"temp_c", dto.TempC},
+		{"timestamp", dto.Timestamp},
+	}
+	for _, v := range values {
+		if math.IsNaN(v.value) || math.IsInf(v.value, 0) {
+			return fmt.Errorf("%s must be a finite number", v.name)
+		}
+	}
+	if dto.WHUsed < 0 {
+		return errors.New("wh_used must not be negative")
+	}
+	if dto.WHGenerated < 0 {
+		return errors.New("wh_generated must not be negative")
+	}
+	if dto.Timestamp <= 0 {
+		return errors.New("timestamp must be positive")
+	}
+	if latest := now.Add(maxSkew); dto.Timestamp > float64(latest.Unix()) {
+		return fmt.Errorf("timestamp is more than %s in the future", maxSkew)
+	}
+	if earliest := now.Add(-maxAge); maxAge > 0 && dto.Timestamp < float64(earliest.Unix()) {
+		return fmt.Errorf("timestamp is more than %s in the past", maxAge)
+	}
+	return nil
+}
+
+// validateSite checks a site registered or updated through the API. Unlike
+// fixture data, these sites must carry a coordinate so they show up in the
+// geo index.
+func validateSite(site models.Site) error {
+	if site.ID <= 0 {
+		return errors.New("id must be positive")
+	}
+	if math.IsNaN(site.Capacity) || math.IsInf(site.Capacity, 0) || site.Capacity <= 0 {
+		return errors.New("capacity must be a positive number")
+	}
+	if site.Panels <= 0 {
+		return errors.New("panels must be positive")
+	}
+	for name, value := range map[string]string{
+		"address": site.Address,
+		"city":    site.City,
+		"state":   site.State,
+	} {
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("%s is required", name)
+		}
+	}
+	if !postalCodePattern.MatchString(site.PostalCode) {
+		return errors.New("postal_code must be a 5-digit ZIP or ZIP+4 code")
+	}
+	if site.Coordinate == nil {
+		return errors.New("coordinate is required")
+	}
+	if lat := site.Coordinate.Lat; math.IsNaN(lat) || lat < -maxGeoLat || lat > maxGeoLat {
+		return fmt.Errorf("coordinate lat must be between -%g and %g", maxGeoLat, maxGeoLat)
+	}
+	if lng := site.Coordinate.Lng; math.IsNaN(lng) || lng < -180 || lng > 180 {
+		return errors.New("coordinate lng must be between -180 and 180")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"redisolar-go/internal/models"
+)
+
+func TestValidateMeterReading(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	skew := 5 * time.Minute
+	maxAge := 14 * 24 * time.Hour
+	valid := MeterReadingDTO{
+		SiteID:      1,
+		WHUsed:      1.5,
+		WHGenerated: 2.5,
+		TempC:       -3.0,
+		Timestamp:   float64(now.Unix()),
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(*MeterReadingDTO)
+		wantErr bool
+	}{
+		{"valid", func(d *MeterReadingDTO) {}, false},
+		{"within skew", func(d *MeterReadingDTO) { d.Timestamp += 4 * 60 }, false},
+		{"zero site", func(d *MeterReadingDTO) { d.SiteID = 0 }, true},
+		{"negative wh_used", func(d *MeterReadingDTO) { d.WHUsed = -1 }, true},
+		{"negative wh_generated", func(d *MeterReadingDTO) { d.WHGenerated = -0.1 }, true},
+		{"infinite temp", func(d *MeterReadingDTO) { d.TempC = math.Inf(1) }, true},
+		{"NaN wh_used", func(d *MeterReadingDTO) { d.WHUsed = math.NaN() }, true},
+		{"zero timestamp", func(d *MeterReadingDTO) { d.Timestamp = 0 }, true},
+		{"future timestamp", func(d *MeterReadingDTO) { d.Timestamp += 6 * 60 }, true},
+		{"within retention", func(d *MeterReadingDTO) { d.Timestamp -= 13 * 24 * 60 * 60 }, false},
+		{"past retention", func(d *MeterReadingDTO) { d.Timestamp -= 15 * 24 * 60 * 60 }, true},
+	}
+
+	for _, tt := range tests {
+		dto := valid
+		tt.mutate(&dto)
+		err := validateMeterReading(dto, now, skew, maxAge)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateMeterReading() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateSite(t *testing.T) {
+	valid := models.Site{
+		ID:         1,
+		Capacity:   4.5,
+		Panels:     3,
+		Address:    "123 Willow St.",
+		City:       "Oakland",
+		State:      "CA",
+		PostalCode: "94577",
+		Coordinate: &models.Coordinate{Lat: 37.7, Lng: -122.2},
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(*models.Site)
+		wantErr bool
+	}{
+		{"valid", func(s *models.Site) {}, false},
+		{"zip+4", func(s *models.Site) { s.PostalCode = "94577-1234" }, false},
+		{"zero id", func(s *models.Site) { s.ID = 0 }, true},
+		{"zero capacity", func(s *models.Site) { s.Capacity = 0 }, true},
+		{"no panels", func(s *models.Site) { s.Panels = 0 }, true},
+		{"blank city", func(s *models.Site) { s.City = " " }, true},
+		{"bad postal code", func(s *models.Site) { s.PostalCode = "9457" }, true},
+		{"no coordinate", func(s *models.Site) { s.Coordinate = nil }, true},
+		{"lat out of range", func(s *models.Site) { s.Coordinate = &models.Coordinate{Lat: 91, Lng: 0} }, true},
+		{"lat beyond geo index", func(s *models.Site) { s.Coordinate = &models.Coordinate{Lat: -85.1, Lng: 0} }, true},
+		{"lat at geo index limit", func(s *models.Site) { s.Coordinate = &models.Coordinate{Lat: 85.05, Lng: 0} }, false},
+		{"lng out of range", func(s *models.Site) { s.Coordinate = &models.Coordinate{Lat: 0, Lng: -181} }, true},
+	}
+
+	for _, tt := range tests {
+		site := valid
+		tt.mutate(&site)
+		err := validateSite(site)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateSite() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
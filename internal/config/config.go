@@ -1,6 +1,10 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 type Config struct {
 	RedisHost      string
@@ -9,7 +13,19 @@ type Config struct {
 	RedisUsername  string
 	RedisPassword  string
 	UseGeoSiteAPI  bool
+	UseSearchAPI   bool
+	ExcessCapacity float64 // threshold above which a site has excess capacity
+	AtomicIngest   bool
+	AsyncIngest    bool
+	ReadingMaxSkew time.Duration
+	DeferStats     bool
+	MetricBackend  string // timeseries or zset
+	MaxFeedStreams int    // feeds streamed over SSE at once
 	ServerPort     string
+
+	WorkerName      string
+	WorkerCount     int
+	WorkerClaimIdle time.Duration
 }
 
 func Load() Config {
@@ -20,14 +36,64 @@ func Load() Config {
 		RedisUsername:  os.Getenv("REDISOLAR_REDIS_USERNAME"),
 		RedisPassword:  os.Getenv("REDISOLAR_REDIS_PASSWORD"),
 		UseGeoSiteAPI:  getEnv("USE_GEO_SITE_API", "true") == "true",
+		UseSearchAPI:   getEnv("USE_SEARCH_SITE_API", "false") == "true",
+		ExcessCapacity: getFloat("EXCESS_CAPACITY_THRESHOLD", 0.2),
+		AtomicIngest:   getEnv("ATOMIC_INGEST", "false") == "true",
+		AsyncIngest:    getEnv("ASYNC_INGEST", "false") == "true",
+		ReadingMaxSkew: getDuration("READING_MAX_SKEW", 5*time.Minute),
+		DeferStats:     getEnv("DEFER_STATS", "false") == "true",
+		MetricBackend:  getEnv("METRIC_BACKEND", "timeseries"),
+		MaxFeedStreams: getInt("MAX_FEED_STREAMS", 50),
 		ServerPort:     getEnv("SERVER_PORT", "8081"),
+
+		WorkerName:      getEnv("WORKER_NAME", hostname()),
+		WorkerCount:     getInt("WORKER_COUNT", 4),
+		WorkerClaimIdle: getDuration("WORKER_CLAIM_IDLE", time.Minute),
 	}
 	return c
 }
 
+// TestRedisAddr returns the address, from REDIS_TEST_ADDR, of a Redis that
+// tests and benchmarks may fill and clear, or "" if none is set. Unlike
+// Load, it has no default, so tests never touch a shared server.
+func TestRedisAddr() string {
+	return os.Getenv("REDIS_TEST_ADDR")
+}
+
 func getEnv(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
 	return fallback
 }
+
+func getDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+func getInt(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func getFloat(key string, fallback float64) float64 {
+	f, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+func hostname() string {
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "worker"
+}
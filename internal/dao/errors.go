@@ -4,3 +4,7 @@ import "errors"
 
 var ErrSiteNotFound = errors.New("site not found")
 var ErrRateLimitExceeded = errors.New("rate limit exceeded")
+var ErrDuplicateReading = errors.New("duplicate meter reading")
+var ErrInvalidCursor = errors.New("invalid cursor")
+var ErrSearchUnavailable = errors.New("search module not available")
+var ErrNoCapacity = errors.New("site has not reported capacity")
@@ -12,15 +12,20 @@ type SiteDao interface {
 	InsertMany(ctx context.Context, sites ...models.Site) error
 	FindByID(ctx context.Context, siteID int) (models.Site, error)
 	FindAll(ctx context.Context) ([]models.Site, error)
+	List(ctx context.Context, query models.SiteQuery) ([]models.Site, string, error)
+	Update(ctx context.Context, site models.Site) error
+	Delete(ctx context.Context, siteID int) error
 }
 
 type SiteGeoDao interface {
 	SiteDao
 	FindByGeo(ctx context.Context, query models.GeoQuery) ([]models.Site, error)
+	FindNearby(ctx context.Context, query models.GeoQuery) ([]models.GeoSite, error)
 }
 
 type SiteStatsDao interface {
 	FindByID(ctx context.Context, siteID int, day time.Time) (models.SiteStats, error)
+	FindByDays(ctx context.Context, siteID int, days []time.Time) ([]models.SiteStats, error)
 	Update(ctx context.Context, reading models.MeterReading) error
 }
 
@@ -28,11 +33,13 @@ type CapacityDao interface {
 	Update(ctx context.Context, reading models.MeterReading) error
 	GetReport(ctx context.Context, limit int) (models.CapacityReport, error)
 	GetRank(ctx context.Context, siteID int) (int64, error)
+	GetSiteRank(ctx context.Context, siteID int, neighbours int) (models.SiteCapacityRank, error)
 }
 
 type MetricDao interface {
 	Insert(ctx context.Context, reading models.MeterReading) error
 	GetRecent(ctx context.Context, siteID int, unit models.MetricUnit, t time.Time, limit int) ([]models.Measurement, error)
+	GetRange(ctx context.Context, siteID int, unit models.MetricUnit, q models.MetricRange) ([]models.Measurement, error)
 }
 
 type FeedDao interface {
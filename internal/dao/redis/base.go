@@ -1,16 +1,85 @@
 package redis
 
 import (
+	"context"
+
 	"github.com/redis/go-redis/v9"
 
 	"redisolar-go/internal/keyschema"
 )
 
+// MetricBackend names how site metrics are stored.
+type MetricBackend string
+
+const (
+	// MetricBackendTimeseries stores metrics as RedisTimeSeries series.
+	MetricBackendTimeseries MetricBackend = "timeseries"
+	// MetricBackendZSet stores metrics in day-bucketed sorted sets, for
+	// servers without the TimeSeries module.
+	MetricBackendZSet MetricBackend = "zset"
+)
+
+// RetentionDays returns how many days of metrics the backend keeps.
+func (b MetricBackend) RetentionDays() int {
+	if b == MetricBackendZSet {
+		return MaxMetricRetentionDays
+	}
+	return RetentionMS / (24 * 60 * 60 * 1000)
+}
+
 type RedisDao struct {
 	Client    *redis.Client
 	KeySchema *keyschema.KeySchema
+	// MetricBackend is where DAOs read and write metrics. The zero value
+	// means MetricBackendTimeseries.
+	MetricBackend MetricBackend
 }
 
 func NewRedisDao(client *redis.Client, ks *keyschema.KeySchema) RedisDao {
 	return RedisDao{Client: client, KeySchema: ks}
 }
+
+// usesTimeseries reports whether metrics are stored with RedisTimeSeries.
+func (d RedisDao) usesTimeseries() bool {
+	return d.MetricBackend != MetricBackendZSet
+}
+
+// maxWatchAttempts is how many times a WATCH transaction is retried when
+// another client changes a watched key before EXEC.
+const maxWatchAttempts = 3
+
+// execEach calls queue for each of n items to add its commands to pipe,
+// executes pipe once and returns one error per item: the error from queue,
+// or else the first error among the commands queued for that item.
+func execEach(ctx context.Context, pipe redis.Pipeliner, n int, queue func(i int) error) []error {
+	errs := make([]error, n)
+	if n == 0 {
+		return errs
+	}
+
+	// bounds[i]:bounds[i+1] is the range of queued commands for item i.
+	bounds := make([]int, n+1)
+	bounds[0] = pipe.Len()
+	for i := 0; i < n; i++ {
+		errs[i] = queue(i)
+		bounds[i+1] = pipe.Len()
+	}
+
+	cmds, execErr := pipe.Exec(ctx)
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			continue
+		}
+		if bounds[i+1] > len(cmds) {
+			errs[i] = execErr
+			continue
+		}
+		for _, cmd := range cmds[bounds[i]:bounds[i+1]] {
+			if err := cmd.Err(); err != nil && err != redis.Nil {
+				errs[i] = err
+				break
+			}
+		}
+	}
+	return errs
+}
@@ -2,11 +2,26 @@ package redis
 
 import (
 	"context"
+	"sort"
 	"strconv"
+	"time"
 
 	goredis "github.com/redis/go-redis/v9"
 
+	"redisolar-go/internal/dao"
 	"redisolar-go/internal/models"
+	"redisolar-go/internal/scripts"
+)
+
+// CapacityAverageAlpha is the weight of each new reading in a site's moving
+// average capacity.
+const CapacityAverageAlpha = 0.1
+
+// How long the hourly and daily capacity rankings are kept after their last
+// reading.
+const (
+	CapacityHourRetention = 48 * time.Hour
+	CapacityDayRetention  = 31 * 24 * time.Hour
 )
 
 type CapacityReportDaoRedis struct {
@@ -21,53 +36,248 @@ func (d *CapacityReportDaoRedis) Update(ctx context.Context, reading models.Mete
 	return d.UpdateWithClient(ctx, reading, d.Client)
 }
 
+// UpdateWithClient records the reading's capacity as the site's current
+// capacity, folds it into the site's moving average and adds it to the
+// site's sum and count of readings for the hour and day of the reading, of
+// which reports rank the mean. On a pipeline the average script must be
+// preloaded with scripts.Preload.
 func (d *CapacityReportDaoRedis) UpdateWithClient(ctx context.Context, reading models.MeterReading, client goredis.Cmdable) error {
 	key := d.KeySchema.CapacityRankingKey()
-	return client.ZAdd(ctx, key, goredis.Z{
+	member := strconv.Itoa(reading.SiteID)
+	err := client.ZAdd(ctx, key, goredis.Z{
 		Score:  reading.CurrentCapacity(),
-		Member: strconv.Itoa(reading.SiteID),
+		Member: member,
 	}).Err()
+	if err != nil {
+		return err
+	}
+	if err := scripts.UpdateCapacityAverage(ctx, client, d.KeySchema.CapacityAverageKey(),
+		reading.SiteID, reading.CurrentCapacity(), CapacityAverageAlpha).Err(); err != nil {
+		return err
+	}
+
+	t := reading.TimestampTime()
+	buckets := []struct {
+		sum, count string
+		retention  time.Duration
+	}{
+		{d.KeySchema.CapacityHourKey(t), d.KeySchema.CapacityHourCountKey(t), CapacityHourRetention},
+		{d.KeySchema.CapacityDayKey(t), d.KeySchema.CapacityDayCountKey(t), CapacityDayRetention},
+	}
+	for _, b := range buckets {
+		if err := client.ZIncrBy(ctx, b.sum, reading.CurrentCapacity(), member).Err(); err != nil {
+			return err
+		}
+		if err := client.ZIncrBy(ctx, b.count, 1, member).Err(); err != nil {
+			return err
+		}
+		if err := client.Expire(ctx, b.sum, b.retention).Err(); err != nil {
+			return err
+		}
+		if err := client.Expire(ctx, b.count, b.retention).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// GetReport returns the sites with the highest and lowest current capacity.
 func (d *CapacityReportDaoRedis) GetReport(ctx context.Context, limit int) (models.CapacityReport, error) {
-	key := d.KeySchema.CapacityRankingKey()
 	pipe := d.Client.Pipeline()
+	low, high := queueReport(ctx, pipe, d.KeySchema.CapacityRankingKey(), limit)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return models.CapacityReport{}, err
+	}
+	return reportFromCmds(low, high), nil
+}
 
-	lowCmd := pipe.ZRangeWithScores(ctx, key, 0, int64(limit-1))
-	highCmd := pipe.ZRevRangeWithScores(ctx, key, 0, int64(limit-1))
-	_, err := pipe.Exec(ctx)
-	if err != nil {
+// GetReportAt returns the sites with the highest and lowest mean capacity
+// over the UTC hour or day containing t. Periods older than their
+// retention come back empty.
+func (d *CapacityReportDaoRedis) GetReportAt(ctx context.Context, bucket models.CapacityBucket, t time.Time, limit int) (models.CapacityReport, error) {
+	if bucket == models.CapacityBucketHour {
+		return d.meanReport(ctx, []string{d.KeySchema.CapacityHourKey(t)},
+			[]string{d.KeySchema.CapacityHourCountKey(t)}, limit)
+	}
+	return d.meanReport(ctx, []string{d.KeySchema.CapacityDayKey(t)},
+		[]string{d.KeySchema.CapacityDayCountKey(t)}, limit)
+}
+
+// GetReportWindow returns the sites with the highest and lowest mean
+// capacity over the hours of the window ending at end, the current hour
+// included. The window is rounded up to whole hours and cannot be longer
+// than CapacityHourRetention.
+func (d *CapacityReportDaoRedis) GetReportWindow(ctx context.Context, window time.Duration, end time.Time, limit int) (models.CapacityReport, error) {
+	hours := int((window + time.Hour - 1) / time.Hour)
+	if hours < 1 {
+		hours = 1
+	}
+	if max := int(CapacityHourRetention / time.Hour); hours > max {
+		hours = max
+	}
+	sumKeys := make([]string, hours)
+	countKeys := make([]string, hours)
+	for i := range sumKeys {
+		t := end.Add(-time.Duration(i) * time.Hour)
+		sumKeys[i] = d.KeySchema.CapacityHourKey(t)
+		countKeys[i] = d.KeySchema.CapacityHourCountKey(t)
+	}
+	return d.meanReport(ctx, sumKeys, countKeys, limit)
+}
+
+// meanReport ranks sites by the mean of their capacity readings: their
+// sums in sumKeys over their counts in countKeys. Several buckets are
+// added up with ZUNIONSTORE first.
+func (d *CapacityReportDaoRedis) meanReport(ctx context.Context, sumKeys, countKeys []string, limit int) (models.CapacityReport, error) {
+	pipe := d.Client.TxPipeline()
+	var sums, counts *goredis.ZSliceCmd
+	if len(sumKeys) == 1 {
+		sums = pipe.ZRangeWithScores(ctx, sumKeys[0], 0, -1)
+		counts = pipe.ZRangeWithScores(ctx, countKeys[0], 0, -1)
+	} else {
+		id := tempID()
+		sumDest := d.KeySchema.TempKey("capacity:" + id)
+		countDest := d.KeySchema.TempKey("capacity:" + id + ":count")
+		pipe.ZUnionStore(ctx, sumDest, &goredis.ZStore{Keys: sumKeys, Aggregate: "SUM"})
+		pipe.ZUnionStore(ctx, countDest, &goredis.ZStore{Keys: countKeys, Aggregate: "SUM"})
+		sums = pipe.ZRangeWithScores(ctx, sumDest, 0, -1)
+		counts = pipe.ZRangeWithScores(ctx, countDest, 0, -1)
+		pipe.Del(ctx, sumDest, countDest)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
 		return models.CapacityReport{}, err
 	}
+	return meanCapacityReport(sums.Val(), counts.Val(), limit), nil
+}
 
-	lowResults, _ := lowCmd.Result()
-	highResults, _ := highCmd.Result()
+// meanCapacityReport divides each site's capacity sum by its reading count
+// and returns the limit sites with the highest and lowest mean. Sites
+// without a count are left out.
+func meanCapacityReport(sums, counts []goredis.Z, limit int) models.CapacityReport {
+	n := make(map[string]float64, len(counts))
+	for _, z := range counts {
+		n[z.Member.(string)] = z.Score
+	}
+	means := make([]models.SiteCapacityTuple, 0, len(sums))
+	for _, z := range sums {
+		member := z.Member.(string)
+		if n[member] <= 0 {
+			continue
+		}
+		siteID, _ := strconv.Atoi(member)
+		means = append(means, models.SiteCapacityTuple{SiteID: siteID, Capacity: z.Score / n[member]})
+	}
+	sort.Slice(means, func(i, j int) bool {
+		if means[i].Capacity != means[j].Capacity {
+			return means[i].Capacity < means[j].Capacity
+		}
+		return means[i].SiteID < means[j].SiteID
+	})
 
-	lowest := make([]models.SiteCapacityTuple, 0, len(lowResults))
-	for _, z := range lowResults {
-		siteID, _ := strconv.Atoi(z.Member.(string))
-		lowest = append(lowest, models.SiteCapacityTuple{
-			SiteID:   siteID,
-			Capacity: z.Score,
-		})
+	if limit > len(means) {
+		limit = len(means)
+	}
+	report := models.CapacityReport{
+		HighestCapacity: make([]models.SiteCapacityTuple, 0, limit),
+		LowestCapacity:  append([]models.SiteCapacityTuple{}, means[:limit]...),
 	}
+	for i := len(means) - 1; i >= len(means)-limit; i-- {
+		report.HighestCapacity = append(report.HighestCapacity, means[i])
+	}
+	return report
+}
 
-	highest := make([]models.SiteCapacityTuple, 0, len(highResults))
-	for _, z := range highResults {
+func queueReport(ctx context.Context, pipe goredis.Pipeliner, key string, limit int) (low, high *goredis.ZSliceCmd) {
+	low = pipe.ZRangeWithScores(ctx, key, 0, int64(limit-1))
+	high = pipe.ZRevRangeWithScores(ctx, key, 0, int64(limit-1))
+	return low, high
+}
+
+func reportFromCmds(lowCmd, highCmd *goredis.ZSliceCmd) models.CapacityReport {
+	return models.CapacityReport{
+		HighestCapacity: capacityTuples(highCmd.Val()),
+		LowestCapacity:  capacityTuples(lowCmd.Val()),
+	}
+}
+
+func capacityTuples(zs []goredis.Z) []models.SiteCapacityTuple {
+	tuples := make([]models.SiteCapacityTuple, 0, len(zs))
+	for _, z := range zs {
 		siteID, _ := strconv.Atoi(z.Member.(string))
-		highest = append(highest, models.SiteCapacityTuple{
+		tuples = append(tuples, models.SiteCapacityTuple{
 			SiteID:   siteID,
 			Capacity: z.Score,
 		})
 	}
-
-	return models.CapacityReport{
-		HighestCapacity: highest,
-		LowestCapacity:  lowest,
-	}, nil
+	return tuples
 }
 
 func (d *CapacityReportDaoRedis) GetRank(ctx context.Context, siteID int) (int64, error) {
 	key := d.KeySchema.CapacityRankingKey()
 	return d.Client.ZRevRank(ctx, key, strconv.Itoa(siteID)).Result()
 }
+
+// GetSiteRank returns the site's place in the current capacity ranking
+// along with up to neighbours sites on either side of it. It returns
+// dao.ErrNoCapacity if the site has no reading.
+func (d *CapacityReportDaoRedis) GetSiteRank(ctx context.Context, siteID int, neighbours int) (models.SiteCapacityRank, error) {
+	key := d.KeySchema.CapacityRankingKey()
+	member := strconv.Itoa(siteID)
+
+	pipe := d.Client.Pipeline()
+	rankCmd := pipe.ZRevRank(ctx, key, member)
+	scoreCmd := pipe.ZScore(ctx, key, member)
+	totalCmd := pipe.ZCard(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != goredis.Nil {
+		return models.SiteCapacityRank{}, err
+	}
+	rank, err := rankCmd.Result()
+	if err == goredis.Nil {
+		return models.SiteCapacityRank{}, dao.ErrNoCapacity
+	}
+	if err != nil {
+		return models.SiteCapacityRank{}, err
+	}
+	total := totalCmd.Val()
+
+	result := models.SiteCapacityRank{
+		SiteID:     siteID,
+		Rank:       rank + 1,
+		Capacity:   scoreCmd.Val(),
+		Percentile: float64(total-rank) / float64(total) * 100,
+		Total:      total,
+		Above:      []models.SiteCapacityTuple{},
+		Below:      []models.SiteCapacityTuple{},
+	}
+	if neighbours <= 0 {
+		return result, nil
+	}
+
+	start := rank - int64(neighbours)
+	if start < 0 {
+		start = 0
+	}
+	around, err := d.Client.ZRevRangeWithScores(ctx, key, start, rank+int64(neighbours)).Result()
+	if err != nil {
+		return models.SiteCapacityRank{}, err
+	}
+	// The ranking may have moved since ZREVRANK, so split on the site
+	// itself rather than on its rank.
+	tuples := capacityTuples(around)
+	for i, t := range tuples {
+		if t.SiteID != siteID {
+			continue
+		}
+		above, below := tuples[:i], tuples[i+1:]
+		if len(above) > neighbours {
+			above = above[len(above)-neighbours:]
+		}
+		if len(below) > neighbours {
+			below = below[:neighbours]
+		}
+		result.Above = append(result.Above, above...)
+		result.Below = append(result.Below, below...)
+		break
+	}
+	return result, nil
+}
@@ -0,0 +1,40 @@
+package redis
+
+import (
+	"testing"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+func TestMeanCapacityReport(t *testing.T) {
+	sums := []goredis.Z{
+		{Member: "1", Score: 60},  // 60 readings of 1.0
+		{Member: "2", Score: 4},   // 2 readings of 2.0
+		{Member: "3", Score: -3},  // 3 readings of -1.0
+		{Member: "4", Score: 100}, // no count, left out
+	}
+	counts := []goredis.Z{
+		{Member: "1", Score: 60},
+		{Member: "2", Score: 2},
+		{Member: "3", Score: 3},
+	}
+
+	report := meanCapacityReport(sums, counts, 2)
+	if len(report.HighestCapacity) != 2 || len(report.LowestCapacity) != 2 {
+		t.Fatalf("meanCapacityReport() = %+v, want 2 sites each way", report)
+	}
+	if h := report.HighestCapacity[0]; h.SiteID != 2 || h.Capacity != 2 {
+		t.Errorf("highest = %+v, want site 2 with 2", h)
+	}
+	if h := report.HighestCapacity[1]; h.SiteID != 1 || h.Capacity != 1 {
+		t.Errorf("second highest = %+v, want site 1 with 1", h)
+	}
+	if l := report.LowestCapacity[0]; l.SiteID != 3 || l.Capacity != -1 {
+		t.Errorf("lowest = %+v, want site 3 with -1", l)
+	}
+
+	empty := meanCapacityReport(nil, nil, 10)
+	if empty.HighestCapacity == nil || len(empty.HighestCapacity) != 0 {
+		t.Errorf("meanCapacityReport(nil) highest = %v, want empty", empty.HighestCapacity)
+	}
+}
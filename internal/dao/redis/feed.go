@@ -3,6 +3,7 @@ package redis
 import (
 	"context"
 	"strconv"
+	"time"
 
 	goredis "github.com/redis/go-redis/v9"
 
@@ -80,6 +81,117 @@ func (d *FeedDaoRedis) getRecent(ctx context.Context, key string, limit int) ([]
 	return readings, nil
 }
 
+// GetGlobalPage returns up to limit entries of the global feed, newest
+// first, with IDs below before and above after. Either cursor may be empty.
+func (d *FeedDaoRedis) GetGlobalPage(ctx context.Context, before string, after string, limit int) ([]models.FeedEntry, error) {
+	return d.getPage(ctx, d.KeySchema.GlobalFeedKey(), before, after, limit)
+}
+
+// GetSitePage is GetGlobalPage for a single site's feed.
+func (d *FeedDaoRedis) GetSitePage(ctx context.Context, siteID int, before string, after string, limit int) ([]models.FeedEntry, error) {
+	return d.getPage(ctx, d.KeySchema.FeedKey(siteID), before, after, limit)
+}
+
+func (d *FeedDaoRedis) getPage(ctx context.Context, key string, before string, after string, limit int) ([]models.FeedEntry, error) {
+	end, start := "+", "-"
+	if before != "" {
+		end = "(" + before
+	}
+	if after != "" {
+		start = "(" + after
+	}
+
+	// With only an after cursor, take the entries right after it (oldest
+	// first) so paging towards newer entries does not skip any.
+	if after != "" && before == "" {
+		messages, err := d.Client.XRangeN(ctx, key, start, end, int64(limit)).Result()
+		if err != nil {
+			return nil, err
+		}
+		entries := messagesToEntries(messages)
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		return entries, nil
+	}
+
+	messages, err := d.Client.XRevRangeN(ctx, key, end, start, int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return messagesToEntries(messages), nil
+}
+
+// LastID returns the ID of the newest entry in a feed stream, or "0-0" if
+// the stream is empty.
+func (d *FeedDaoRedis) LastID(ctx context.Context, key string) (string, error) {
+	messages, err := d.Client.XRevRangeN(ctx, key, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+	return messages[0].ID, nil
+}
+
+// RangeAfter returns up to limit entries of a feed stream with IDs greater
+// than afterID, oldest first, and the ID to continue from: that of the last
+// message read, even if it was not a valid meter reading, or afterID if
+// there were none.
+func (d *FeedDaoRedis) RangeAfter(ctx context.Context, key string, afterID string, limit int) ([]models.FeedEntry, string, error) {
+	messages, err := d.Client.XRangeN(ctx, key, "("+afterID, "+", int64(limit)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	return messagesToEntries(messages), lastMessageID(messages, afterID), nil
+}
+
+// ReadAfter blocks for up to block waiting for entries of a feed stream
+// with IDs greater than afterID. It returns no entries if none arrived, and
+// the ID to continue from, as RangeAfter does.
+func (d *FeedDaoRedis) ReadAfter(ctx context.Context, key string, afterID string, limit int, block time.Duration) ([]models.FeedEntry, string, error) {
+	streams, err := d.Client.XRead(ctx, &goredis.XReadArgs{
+		Streams: []string{key, afterID},
+		Count:   int64(limit),
+		Block:   block,
+	}).Result()
+	if err == goredis.Nil {
+		return nil, afterID, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var entries []models.FeedEntry
+	lastID := afterID
+	for _, stream := range streams {
+		entries = append(entries, messagesToEntries(stream.Messages)...)
+		lastID = lastMessageID(stream.Messages, lastID)
+	}
+	return entries, lastID, nil
+}
+
+// lastMessageID returns the ID of the last of messages, or fallback if
+// there are none.
+func lastMessageID(messages []goredis.XMessage, fallback string) string {
+	if len(messages) == 0 {
+		return fallback
+	}
+	return messages[len(messages)-1].ID
+}
+
+func messagesToEntries(messages []goredis.XMessage) []models.FeedEntry {
+	entries := make([]models.FeedEntry, 0, len(messages))
+	for _, msg := range messages {
+		reading, err := streamMapToMeterReading(msg.Values)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, models.FeedEntry{ID: msg.ID, Reading: reading})
+	}
+	return entries
+}
+
 func streamMapToMeterReading(m map[string]interface{}) (models.MeterReading, error) {
 	siteID, err := parseIntField(m, "site_id")
 	if err != nil {
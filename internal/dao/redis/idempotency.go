@@ -0,0 +1,47 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+type IdempotencyDaoRedis struct {
+	RedisDao
+}
+
+func NewIdempotencyDao(base RedisDao) *IdempotencyDaoRedis {
+	return &IdempotencyDaoRedis{RedisDao: base}
+}
+
+// Get returns the response stored for an idempotency key, if any.
+func (d *IdempotencyDaoRedis) Get(ctx context.Context, key string) (string, bool, error) {
+	val, err := d.Client.Get(ctx, d.KeySchema.IdempotencyKey(key)).Result()
+	if err == goredis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return val, true, nil
+}
+
+// Reserve claims an idempotency key with an in-progress value, unless the
+// key is already claimed or holds a response. It reports whether the key
+// was claimed.
+func (d *IdempotencyDaoRedis) Reserve(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	return d.Client.SetNX(ctx, d.KeySchema.IdempotencyKey(key), value, ttl).Result()
+}
+
+// Save stores the response for an idempotency key, replacing its
+// reservation.
+func (d *IdempotencyDaoRedis) Save(ctx context.Context, key string, response string, ttl time.Duration) error {
+	return d.Client.Set(ctx, d.KeySchema.IdempotencyKey(key), response, ttl).Err()
+}
+
+// Release removes the reservation of an idempotency key whose request did
+// not complete, so it can be retried.
+func (d *IdempotencyDaoRedis) Release(ctx context.Context, key string) error {
+	return d.Client.Del(ctx, d.KeySchema.IdempotencyKey(key)).Err()
+}
@@ -2,13 +2,22 @@ package redis
 
 import (
 	"context"
+	"time"
 
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/dao"
 	"redisolar-go/internal/models"
+	"redisolar-go/internal/scripts"
 )
 
 type MeterReadingDaoRedis struct {
 	RedisDao
-	metricDao   *MetricDaoRedisTimeseries
+	// DeferStats queues readings on the stats queue instead of updating
+	// the site stats on ingest, for deployments where a worker maintains
+	// the stats.
+	DeferStats  bool
+	metricDao   MetricStore
 	capacityDao *CapacityReportDaoRedis
 	feedDao     *FeedDaoRedis
 	statsDao    *SiteStatsDaoRedis
@@ -17,26 +26,265 @@ type MeterReadingDaoRedis struct {
 func NewMeterReadingDao(base RedisDao) *MeterReadingDaoRedis {
 	return &MeterReadingDaoRedis{
 		RedisDao:    base,
-		metricDao:   NewMetricTimeseriesDao(base),
+		metricDao:   NewMetricStore(base),
 		capacityDao: NewCapacityReportDao(base),
 		feedDao:     NewFeedDao(base),
 		statsDao:    NewSiteStatsDao(base),
 	}
 }
 
+// DedupeTTL is how long the (site, timestamp) marker of an ingested reading
+// is kept, and so how late a retried reading is still recognised.
+const DedupeTTL = 24 * time.Hour
+
+// Add writes a single reading, returning dao.ErrDuplicateReading if a
+// reading for the same site and timestamp was already ingested.
 func (d *MeterReadingDaoRedis) Add(ctx context.Context, reading models.MeterReading) error {
-	return d.AddWithPipeline(ctx, reading, nil)
+	return d.AddMany(ctx, []models.MeterReading{reading})[0]
 }
 
-func (d *MeterReadingDaoRedis) AddWithPipeline(ctx context.Context, reading models.MeterReading, pipe interface{}) error {
-	if err := d.metricDao.Insert(ctx, reading); err != nil {
+// AddWithPipeline queues the metric, capacity, feed and stats writes for a
+// reading on pipe. If pipe is nil, a new pipeline is created and executed.
+func (d *MeterReadingDaoRedis) AddWithPipeline(ctx context.Context, reading models.MeterReading, pipe goredis.Pipeliner) error {
+	execute := false
+	if pipe == nil {
+		pipe = d.Client.Pipeline()
+		scripts.Preload(ctx, pipe)
+		execute = true
+	}
+
+	if err := d.metricDao.InsertWithPipeline(ctx, reading, pipe); err != nil {
 		return err
 	}
-	if err := d.capacityDao.Update(ctx, reading); err != nil {
+	if err := d.capacityDao.UpdateWithClient(ctx, reading, pipe); err != nil {
 		return err
 	}
-	if err := d.feedDao.Insert(ctx, reading); err != nil {
+	if err := d.feedDao.InsertWithPipeline(ctx, reading, pipe); err != nil {
+		return err
+	}
+	if d.DeferStats {
+		d.statsDao.EnqueueWithPipeline(ctx, reading, pipe)
+	} else if err := d.statsDao.UpdateWithPipeline(ctx, reading, pipe); err != nil {
+		return err
+	}
+
+	if execute {
+		_, err := pipe.Exec(ctx)
 		return err
 	}
 	return nil
 }
+
+// AddMany writes a batch of readings in a single MULTI/EXEC. The returned
+// slice has one entry per reading: nil if every command queued for that
+// reading succeeded, dao.ErrDuplicateReading if the same site and timestamp
+// was already ingested, otherwise the first error among its commands.
+//
+// The dedupe markers are checked under WATCH and set in the same
+// transaction as the readings' writes, so a marker never exists without its
+// reading. EXEC does not roll back, so a reading whose commands fail may
+// still have written some of them; it keeps its marker so a retry cannot
+// apply it twice. Only readings that failed before queueing any command
+// have their marker released.
+func (d *MeterReadingDaoRedis) AddMany(ctx context.Context, readings []models.MeterReading) []error {
+	errs := make([]error, len(readings))
+	if len(readings) == 0 {
+		return errs
+	}
+
+	keys := make([]string, len(readings))
+	for i, reading := range readings {
+		keys[i] = d.KeySchema.ReadingDedupeKey(reading.SiteID, reading.TimestampTime())
+	}
+
+	unwritten := make([]bool, len(readings))
+	var err error
+	for attempt := 0; attempt < maxWatchAttempts; attempt++ {
+		err = d.Client.Watch(ctx, func(tx *goredis.Tx) error {
+			return d.addDeduped(ctx, tx, readings, keys, errs, unwritten)
+		}, keys...)
+		if err != goredis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	var failed []string
+	for i := range errs {
+		if unwritten[i] {
+			failed = append(failed, keys[i])
+		}
+	}
+	d.release(ctx, failed)
+	return errs
+}
+
+// addDeduped writes the readings whose dedupe marker does not exist yet,
+// together with their markers, in one MULTI/EXEC on tx. It fills errs, and
+// unwritten for the readings that failed without queueing any command. It
+// returns goredis.TxFailedErr if a watched marker changed, so the batch can
+// be retried.
+func (d *MeterReadingDaoRedis) addDeduped(ctx context.Context, tx *goredis.Tx, readings []models.MeterReading, keys []string, errs []error, unwritten []bool) error {
+	exists := make([]*goredis.IntCmd, len(keys))
+	check := tx.Pipeline()
+	for i, key := range keys {
+		exists[i] = check.Exists(ctx, key)
+	}
+	if _, err := check.Exec(ctx); err != nil {
+		return err
+	}
+
+	var fresh []int
+	var batch []models.MeterReading
+	seen := make(map[string]bool)
+	for i, cmd := range exists {
+		errs[i] = nil
+		unwritten[i] = false
+		if cmd.Val() > 0 || seen[keys[i]] {
+			errs[i] = dao.ErrDuplicateReading
+			continue
+		}
+		seen[keys[i]] = true
+		fresh = append(fresh, i)
+		batch = append(batch, readings[i])
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	pipe := tx.TxPipeline()
+	for _, i := range fresh {
+		pipe.Set(ctx, keys[i], 1, DedupeTTL)
+	}
+	batchErrs, batchUnwritten := d.addBatch(ctx, batch, pipe)
+	for j, err := range batchErrs {
+		if err == goredis.TxFailedErr {
+			return err
+		}
+		errs[fresh[j]] = err
+		unwritten[fresh[j]] = batchUnwritten[j]
+	}
+	return nil
+}
+
+func (d *MeterReadingDaoRedis) release(ctx context.Context, dedupeKeys []string) {
+	if len(dedupeKeys) > 0 {
+		d.Client.Del(ctx, dedupeKeys...)
+	}
+}
+
+// addBatch queues and executes the readings on pipe, returning one error
+// per reading and whether each failed reading queued no command at all.
+func (d *MeterReadingDaoRedis) addBatch(ctx context.Context, readings []models.MeterReading, pipe goredis.Pipeliner) ([]error, []bool) {
+	if len(readings) > 0 {
+		scripts.Preload(ctx, pipe)
+	}
+	unwritten := make([]bool, len(readings))
+	errs := execEach(ctx, pipe, len(readings), func(i int) error {
+		queued := pipe.Len()
+		err := d.AddWithPipeline(ctx, readings[i], pipe)
+		unwritten[i] = err != nil && pipe.Len() == queued
+		return err
+	})
+	return errs, unwritten
+}
+
+// Enqueue appends readings to the ingest stream in one round trip, leaving
+// the actual writes to an ingest worker. Nothing is trimmed from the
+// stream here; the worker deletes entries once they are ingested.
+func (d *MeterReadingDaoRedis) Enqueue(ctx context.Context, readings []models.MeterReading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	pipe := d.Client.Pipeline()
+	for _, reading := range readings {
+		pipe.XAdd(ctx, &goredis.XAddArgs{
+			Stream: d.KeySchema.IngestStreamKey(),
+			Values: models.MeterReadingToStreamMap(reading),
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// AddAtomic writes a batch of readings with the add_meter_readings script,
+// so the metrics, capacity ranking, feeds and stats for the whole batch are
+// updated in one atomic step. The returned slice is shaped like the one
+// from AddMany; if the script fails, nothing is written and every reading
+// carries its error.
+func (d *MeterReadingDaoRedis) AddAtomic(ctx context.Context, readings []models.MeterReading) []error {
+	errs := make([]error, len(readings))
+	if len(readings) == 0 {
+		return errs
+	}
+
+	keys := make([]string, 0, 4+len(readings)*10)
+	keys = append(keys,
+		d.KeySchema.CapacityRankingKey(),
+		d.KeySchema.GlobalFeedKey(),
+		d.KeySchema.CapacityAverageKey(),
+		d.KeySchema.StatsQueueKey(),
+	)
+
+	args := make([]interface{}, 0, 12+len(readings)*8)
+	args = append(args,
+		RetentionMS,
+		GlobalMaxFeedLength,
+		SiteMaxFeedLength,
+		WeekSeconds,
+		time.Now().UTC().Format(time.RFC3339),
+		int64(DedupeTTL/time.Second),
+		!d.DeferStats,
+		CapacityAverageAlpha,
+		int64(CapacityHourRetention/time.Second),
+		int64(CapacityDayRetention/time.Second),
+		d.usesTimeseries(),
+		MetricExpirationSeconds,
+	)
+
+	for _, reading := range readings {
+		t := reading.TimestampTime()
+		for _, unit := range metricUnits {
+			if d.usesTimeseries() {
+				keys = append(keys, d.KeySchema.TimeseriesKey(reading.SiteID, unit))
+			} else {
+				keys = append(keys, d.KeySchema.DayMetricKey(reading.SiteID, unit, t))
+			}
+		}
+		keys = append(keys,
+			d.KeySchema.FeedKey(reading.SiteID),
+			d.KeySchema.SiteStatsKey(reading.SiteID, t),
+			d.KeySchema.ReadingDedupeKey(reading.SiteID, t),
+			d.KeySchema.CapacityHourKey(t),
+			d.KeySchema.CapacityDayKey(t),
+			d.KeySchema.CapacityHourCountKey(t),
+			d.KeySchema.CapacityDayCountKey(t),
+		)
+		args = append(args,
+			reading.SiteID,
+			reading.WHUsed,
+			reading.WHGenerated,
+			reading.TempC,
+			reading.Timestamp,
+			unixMilliseconds(t),
+			reading.CurrentCapacity(),
+			getDayMinute(t),
+		)
+	}
+
+	written, err := scripts.AddMeterReadingsScript.Run(ctx, d.Client, keys, args...).Int64Slice()
+	for i := range errs {
+		switch {
+		case err != nil:
+			errs[i] = err
+		case i < len(written) && written[i] == 0:
+			errs[i] = dao.ErrDuplicateReading
+		}
+	}
+	return errs
+}
@@ -3,12 +3,14 @@ package redis
 import (
 	"context"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
 	goredis "github.com/redis/go-redis/v9"
 
+	"redisolar-go/internal/dao"
 	"redisolar-go/internal/models"
 )
 
@@ -19,6 +21,40 @@ const (
 	MetricExpirationSeconds   = 60 * 60 * 24 * MaxMetricRetentionDays + 1
 )
 
+// MetricStore is a dao.MetricDao that can also queue its writes on a
+// pipeline. MetricDaoRedis and MetricDaoRedisTimeseries both implement it.
+type MetricStore interface {
+	dao.MetricDao
+	InsertWithPipeline(ctx context.Context, reading models.MeterReading, pipe goredis.Pipeliner) error
+	InsertMeasurementWithPipeline(ctx context.Context, m models.Measurement, pipe goredis.Pipeliner)
+}
+
+// NewMetricStore returns the metric DAO for base.MetricBackend.
+func NewMetricStore(base RedisDao) MetricStore {
+	if base.usesTimeseries() {
+		return NewMetricTimeseriesDao(base)
+	}
+	return NewMetricDao(base)
+}
+
+// ParseMetricBackend returns the backend named s, defaulting to
+// MetricBackendTimeseries when s is empty.
+func ParseMetricBackend(s string) (MetricBackend, error) {
+	switch b := MetricBackend(s); b {
+	case "":
+		return MetricBackendTimeseries, nil
+	case MetricBackendTimeseries, MetricBackendZSet:
+		return b, nil
+	default:
+		return "", fmt.Errorf("unknown metric backend %q, expected %s or %s", s, MetricBackendTimeseries, MetricBackendZSet)
+	}
+}
+
+// measurementTime returns a measurement's timestamp as a time.Time.
+func measurementTime(m models.Measurement) time.Time {
+	return time.UnixMilli(int64(math.Round(m.Timestamp * 1000)))
+}
+
 type MetricDaoRedis struct {
 	RedisDao
 }
@@ -50,6 +86,12 @@ func (d *MetricDaoRedis) InsertWithPipeline(ctx context.Context, reading models.
 	return nil
 }
 
+// InsertMeasurementWithPipeline queues the write of a single measurement,
+// such as one copied from the other backend, on pipe.
+func (d *MetricDaoRedis) InsertMeasurementWithPipeline(ctx context.Context, m models.Measurement, pipe goredis.Pipeliner) {
+	d.insertMetric(ctx, m.SiteID, m.Value, m.MetricUnit, measurementTime(m), pipe)
+}
+
 func (d *MetricDaoRedis) insertMetric(ctx context.Context, siteID int, value float64, unit models.MetricUnit, t time.Time, pipe goredis.Pipeliner) {
 	metricKey := d.KeySchema.DayMetricKey(siteID, unit, t)
 	minuteOfDay := getDayMinute(t)
@@ -88,6 +130,103 @@ func (d *MetricDaoRedis) GetRecent(ctx context.Context, siteID int, unit models.
 	return collected, nil
 }
 
+// GetRange returns the site's measurements of unit within q.From and q.To,
+// oldest first, reading every day's sorted set in one pipeline. With
+// q.Bucket set they are combined the way TS.RANGE AGGREGATION would. At
+// most q.Limit measurements are returned.
+func (d *MetricDaoRedis) GetRange(ctx context.Context, siteID int, unit models.MetricUnit, q models.MetricRange) ([]models.Measurement, error) {
+	from, to := q.From.Local(), q.To.Local()
+	if oldest := time.Now().AddDate(0, 0, -MaxMetricRetentionDays); from.Before(oldest) {
+		from = oldest
+	}
+	measurements := []models.Measurement{}
+	if from.After(to) {
+		return measurements, nil
+	}
+
+	pipe := d.Client.Pipeline()
+	var days []time.Time
+	var cmds []*goredis.ZSliceCmd
+	for day := getDateFromDayMinute(from, 0); !day.After(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+		cmds = append(cmds, pipe.ZRangeWithScores(ctx, d.KeySchema.DayMetricKey(siteID, unit, day), 0, -1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		for _, z := range cmd.Val() {
+			value, minuteOfDay, err := parseMeasurementMinute(z.Member.(string))
+			if err != nil {
+				continue
+			}
+			ts := getDateFromDayMinute(days[i], minuteOfDay)
+			if ts.Before(from) || ts.After(to) {
+				continue
+			}
+			measurements = append(measurements, models.Measurement{
+				SiteID:     siteID,
+				MetricUnit: unit,
+				Timestamp:  float64(ts.Unix()),
+				Value:      value,
+			})
+		}
+	}
+
+	if q.Bucket > 0 {
+		measurements = aggregateMeasurements(measurements, q.Bucket, q.Aggregation)
+	}
+	if q.Limit > 0 && len(measurements) > q.Limit {
+		measurements = measurements[:q.Limit]
+	}
+	return measurements, nil
+}
+
+// aggregateMeasurements combines time-ordered measurements into buckets
+// aligned to the Unix epoch, each stamped with its start, as TS.RANGE
+// AGGREGATION does. An empty agg means average.
+func aggregateMeasurements(ms []models.Measurement, bucket time.Duration, agg models.MetricAggregation) []models.Measurement {
+	bucketMs := bucket.Milliseconds()
+	var out []models.Measurement
+	var sum float64
+	var count int
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		last := &out[len(out)-1]
+		switch agg {
+		case models.MetricAggSum:
+			last.Value = sum
+		case models.MetricAggMin, models.MetricAggMax:
+		default:
+			last.Value = sum / float64(count)
+		}
+	}
+	for _, m := range ms {
+		start := int64(math.Floor(m.Timestamp*1000/float64(bucketMs))) * bucketMs
+		if len(out) == 0 || int64(out[len(out)-1].Timestamp*1000) != start {
+			flush()
+			m.Timestamp = float64(start) / 1000
+			out = append(out, m)
+			sum, count = m.Value, 1
+			continue
+		}
+		last := &out[len(out)-1]
+		switch agg {
+		case models.MetricAggMin:
+			last.Value = math.Min(last.Value, m.Value)
+		case models.MetricAggMax:
+			last.Value = math.Max(last.Value, m.Value)
+		}
+		sum += m.Value
+		count++
+	}
+	flush()
+	return out
+}
+
 func (d *MetricDaoRedis) getMeasurementsForDate(ctx context.Context, siteID int, date time.Time, unit models.MetricUnit, count int) ([]models.Measurement, error) {
 	key := d.KeySchema.DayMetricKey(siteID, unit, date)
 	results, err := d.Client.ZRevRangeWithScores(ctx, key, 0, int64(count-1)).Result()
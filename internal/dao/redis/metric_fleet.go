@@ -0,0 +1,229 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"redisolar-go/internal/models"
+)
+
+// DefaultFleetBucket is the bucket fleet ranges are aggregated into when
+// none is given. REDUCE only combines samples with the same timestamp, and
+// sites report at different seconds, so their samples are first aligned
+// to the bucket.
+const DefaultFleetBucket = time.Minute
+
+// GetFleetRange returns q.Unit's measurements over q.Range across the sites
+// matching q, reduced with TS.MRANGE GROUPBY into one series per state or
+// city, or a single series for the whole fleet. Series are returned in
+// group order.
+func (d *MetricDaoRedisTimeseries) GetFleetRange(ctx context.Context, q models.FleetQuery) ([]models.FleetSeries, error) {
+	r := q.Range
+	if r.Bucket <= 0 {
+		r.Bucket = DefaultFleetBucket
+	}
+	if r.Aggregation == "" {
+		r.Aggregation = models.MetricAggAvg
+	}
+	args := []interface{}{"TS.MRANGE", unixMilliseconds(r.From), unixMilliseconds(r.To)}
+	if r.Limit > 0 {
+		args = append(args, "COUNT", r.Limit)
+	}
+	args = append(args, "AGGREGATION", string(r.Aggregation), r.Bucket.Milliseconds())
+	args = append(args, d.fleetFilter(q, compactionBucket(r))...)
+	// Every series carries the prefix label, so grouping by it reduces the
+	// whole fleet into one series.
+	group := "prefix"
+	if q.GroupBy != models.FleetGroupAll {
+		group = string(q.GroupBy)
+	}
+	args = append(args, "GROUPBY", group, "REDUCE", string(fleetReducer(q.Reduce)))
+
+	reply, err := d.Client.Do(ctx, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseTSEntries(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]models.FleetSeries, 0, len(entries))
+	for _, e := range entries {
+		s := models.FleetSeries{}
+		if q.GroupBy != models.FleetGroupAll {
+			// Grouped series are named after their group, as in "state=ca".
+			s.Group = e.Key[strings.LastIndex(e.Key, "=")+1:]
+		}
+		s.Measurements, err = parseRange(e.Data, 0, q.Unit, 0)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Group < series[j].Group })
+	return series, nil
+}
+
+// GetFleetLatest returns the latest q.Unit measurement of each site
+// matching q, read with TS.MGET and reduced per state or city, or for the
+// whole fleet. Values are returned in group order.
+func (d *MetricDaoRedisTimeseries) GetFleetLatest(ctx context.Context, q models.FleetQuery) ([]models.FleetValue, error) {
+	args := append([]interface{}{"TS.MGET", "WITHLABELS"}, d.fleetFilter(q, "raw")...)
+	reply, err := d.Client.Do(ctx, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseTSEntries(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]float64)
+	for _, e := range entries {
+		if len(e.Data) != 2 {
+			continue // no sample yet
+		}
+		v, err := toFloat(e.Data[1])
+		if err != nil {
+			continue
+		}
+		group := ""
+		if q.GroupBy != models.FleetGroupAll {
+			group = e.Labels[string(q.GroupBy)]
+		}
+		groups[group] = append(groups[group], v)
+	}
+
+	values := make([]models.FleetValue, 0, len(groups))
+	for group, vs := range groups {
+		values = append(values, models.FleetValue{
+			Group: group,
+			Value: reduceValues(vs, fleetReducer(q.Reduce)),
+			Sites: len(vs),
+		})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Group < values[j].Group })
+	return values, nil
+}
+
+// fleetFilter returns the FILTER clause selecting the series of q.Unit
+// with the given bucket label for this key prefix and q's state and city.
+func (d *MetricDaoRedisTimeseries) fleetFilter(q models.FleetQuery, bucket string) []interface{} {
+	filter := []interface{}{
+		"FILTER",
+		"prefix=" + d.KeySchema.Prefix,
+		"unit=" + string(q.Unit),
+		"bucket=" + bucket,
+	}
+	if q.State != "" {
+		filter = append(filter, "state="+seriesLabel(q.State))
+	}
+	if q.City != "" {
+		filter = append(filter, "city="+seriesLabel(q.City))
+	}
+	return filter
+}
+
+func fleetReducer(agg models.MetricAggregation) models.MetricAggregation {
+	if agg == "" {
+		return models.MetricAggSum
+	}
+	return agg
+}
+
+func reduceValues(vs []float64, agg models.MetricAggregation) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	result := vs[0]
+	for _, v := range vs[1:] {
+		switch agg {
+		case models.MetricAggMin:
+			result = math.Min(result, v)
+		case models.MetricAggMax:
+			result = math.Max(result, v)
+		default:
+			result += v
+		}
+	}
+	if agg == models.MetricAggAvg {
+		result /= float64(len(vs))
+	}
+	return result
+}
+
+// tsEntry is one series from a TS.MRANGE or TS.MGET reply: its key, its
+// labels if requested, and its samples (MRANGE) or latest sample (MGET).
+type tsEntry struct {
+	Key    string
+	Labels map[string]string
+	Data   []interface{}
+}
+
+// parseTSEntries reads the series of a TS.MRANGE or TS.MGET reply, in
+// either its RESP2 or RESP3 form. The data is always the last element of a
+// series, after its labels and, when grouped, its reducer and sources.
+func parseTSEntries(reply interface{}) ([]tsEntry, error) {
+	switch v := reply.(type) {
+	case []interface{}:
+		// RESP2: one array per series of key, labels, data.
+		entries := make([]tsEntry, 0, len(v))
+		for _, item := range v {
+			fields, ok := item.([]interface{})
+			if !ok || len(fields) < 2 {
+				continue
+			}
+			data, _ := fields[len(fields)-1].([]interface{})
+			entries = append(entries, tsEntry{
+				Key:    fmt.Sprint(fields[0]),
+				Labels: parseTSLabels(fields[1]),
+				Data:   data,
+			})
+		}
+		return entries, nil
+	case map[interface{}]interface{}:
+		// RESP3: a map from key to an array of labels, then data.
+		entries := make([]tsEntry, 0, len(v))
+		for key, item := range v {
+			fields, ok := item.([]interface{})
+			if !ok || len(fields) == 0 {
+				continue
+			}
+			data, _ := fields[len(fields)-1].([]interface{})
+			entries = append(entries, tsEntry{
+				Key:    fmt.Sprint(key),
+				Labels: parseTSLabels(fields[0]),
+				Data:   data,
+			})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		return entries, nil
+	default:
+		return nil, fmt.Errorf("unexpected timeseries reply %T", reply)
+	}
+}
+
+// parseTSLabels reads labels given as name/value pairs (RESP2) or a map
+// (RESP3).
+func parseTSLabels(v interface{}) map[string]string {
+	labels := make(map[string]string)
+	switch l := v.(type) {
+	case []interface{}:
+		for _, pair := range l {
+			p, ok := pair.([]interface{})
+			if ok && len(p) == 2 {
+				labels[fmt.Sprint(p[0])] = fmt.Sprint(p[1])
+			}
+		}
+	case map[interface{}]interface{}:
+		for name, value := range l {
+			labels[fmt.Sprint(name)] = fmt.Sprint(value)
+		}
+	}
+	return labels
+}
@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"testing"
+
+	"redisolar-go/internal/models"
+)
+
+func TestParseTSEntries(t *testing.T) {
+	resp2 := []interface{}{
+		[]interface{}{
+			"state=ca",
+			[]interface{}{
+				[]interface{}{"state", "ca"},
+				[]interface{}{"__reducer__", "sum"},
+			},
+			[]interface{}{
+				[]interface{}{int64(1000), "1.5"},
+				[]interface{}{int64(2000), "2.5"},
+			},
+		},
+	}
+	resp3 := map[interface{}]interface{}{
+		"state=ca": []interface{}{
+			map[interface{}]interface{}{"state": "ca"},
+			map[interface{}]interface{}{"reducers": []interface{}{"sum"}},
+			[]interface{}{
+				[]interface{}{int64(1000), 1.5},
+				[]interface{}{int64(2000), 2.5},
+			},
+		},
+	}
+
+	for name, reply := range map[string]interface{}{"RESP2": resp2, "RESP3": resp3} {
+		entries, err := parseTSEntries(reply)
+		if err != nil {
+			t.Fatalf("%s: parseTSEntries() error = %v", name, err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("%s: parseTSEntries() = %d entries, want 1", name, len(entries))
+		}
+		e := entries[0]
+		if e.Key != "state=ca" || e.Labels["state"] != "ca" {
+			t.Errorf("%s: parseTSEntries() key = %q, labels = %v", name, e.Key, e.Labels)
+		}
+		ms, err := parseRange(e.Data, 0, models.WHGenerated, 0)
+		if err != nil {
+			t.Fatalf("%s: parseRange() error = %v", name, err)
+		}
+		if len(ms) != 2 || ms[0].Timestamp != 1 || ms[1].Value != 2.5 {
+			t.Errorf("%s: parseRange() = %v", name, ms)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"redisolar-go/internal/models"
+)
+
+func TestAggregateMeasurements(t *testing.T) {
+	ms := []models.Measurement{
+		{Timestamp: 3600, Value: 1},
+		{Timestamp: 3660, Value: 3},
+		{Timestamp: 7200, Value: 10},
+		{Timestamp: 7260, Value: 2},
+		{Timestamp: 7320, Value: 6},
+	}
+	tests := []struct {
+		agg  models.MetricAggregation
+		want []float64
+	}{
+		{"", []float64{2, 6}},
+		{models.MetricAggAvg, []float64{2, 6}},
+		{models.MetricAggSum, []float64{4, 18}},
+		{models.MetricAggMin, []float64{1, 2}},
+		{models.MetricAggMax, []float64{3, 10}},
+	}
+
+	for _, tt := range tests {
+		got := aggregateMeasurements(ms, time.Hour, tt.agg)
+		if len(got) != len(tt.want) {
+			t.Fatalf("aggregateMeasurements(%q) = %d buckets, want %d", tt.agg, len(got), len(tt.want))
+		}
+		for i, m := range got {
+			if m.Value != tt.want[i] || m.Timestamp != float64(3600*(i+1)) {
+				t.Errorf("aggregateMeasurements(%q)[%d] = %v at %v, want %v at %v",
+					tt.agg, i, m.Value, m.Timestamp, tt.want[i], 3600*(i+1))
+			}
+		}
+	}
+}
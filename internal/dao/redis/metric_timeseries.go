@@ -4,14 +4,31 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	goredis "github.com/redis/go-redis/v9"
 
+	"redisolar-go/internal/keyschema"
 	"redisolar-go/internal/models"
+	"redisolar-go/internal/scripts"
 )
 
-const RetentionMS = 60 * 60 * 24 * 14 * 1000 // 14 days in ms
+const (
+	RetentionMS = 60 * 60 * 24 * 14 * 1000 // 14 days in ms
+
+	// Hourly compactions are kept for a year and daily ones indefinitely.
+	HourlyRetentionMS = 60 * 60 * 24 * 366 * 1000
+	DailyRetentionMS  = 0
+
+	// CompactionAggregation is how minute measurements are combined into
+	// the hourly and daily compactions.
+	CompactionAggregation = models.MetricAggAvg
+
+	// DuplicatePolicy lets a retried reading overwrite the sample it already
+	// wrote instead of failing the whole write.
+	DuplicatePolicy = "LAST"
+)
 
 type MetricDaoRedisTimeseries struct {
 	RedisDao
@@ -25,6 +42,76 @@ func unixMilliseconds(t time.Time) int64 {
 	return t.UnixNano() / int64(time.Millisecond)
 }
 
+// metricUnits are the units every site has a timeseries for.
+var metricUnits = []models.MetricUnit{models.WHGenerated, models.WHUsed, models.TempCelsius}
+
+// CreateSeries creates the site's timeseries and their compactions, or
+// refreshes their labels if they exist.
+func (d *MetricDaoRedisTimeseries) CreateSeries(ctx context.Context, site models.Site) error {
+	return createSiteSeries(ctx, d.KeySchema, site, d.Client)
+}
+
+// CreateSeriesMany runs CreateSeries for each of sites, pipelining the
+// script in chunks of siteFetchChunk, for sites registered before their
+// series were created with labels and compactions.
+func (d *MetricDaoRedisTimeseries) CreateSeriesMany(ctx context.Context, sites []models.Site) error {
+	for start := 0; start < len(sites); start += siteFetchChunk {
+		end := start + siteFetchChunk
+		if end > len(sites) {
+			end = len(sites)
+		}
+		pipe := d.Client.Pipeline()
+		scripts.Preload(ctx, pipe)
+		errs := execEach(ctx, pipe, end-start, func(i int) error {
+			return createSiteSeries(ctx, d.KeySchema, sites[start+i], pipe)
+		})
+		for i, err := range errs {
+			if err != nil {
+				return fmt.Errorf("site %d: %w", sites[start+i].ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// createSiteSeries runs the create_site_series script for site. Series are
+// labelled with the key prefix and the site's ID, state and city so they
+// can be queried together. On a pipeline the script must be preloaded with
+// scripts.Preload.
+func createSiteSeries(ctx context.Context, ks *keyschema.KeySchema, site models.Site, client goredis.Scripter) error {
+	keys := make([]string, 0, len(metricUnits)*3)
+	args := []interface{}{
+		RetentionMS,
+		HourlyRetentionMS,
+		DailyRetentionMS,
+		time.Hour.Milliseconds(),
+		(24 * time.Hour).Milliseconds(),
+		string(CompactionAggregation),
+	}
+	for _, unit := range metricUnits {
+		keys = append(keys,
+			ks.TimeseriesKey(site.ID, unit),
+			ks.TimeseriesHourKey(site.ID, unit),
+			ks.TimeseriesDayKey(site.ID, unit),
+		)
+		args = append(args, string(unit))
+	}
+	args = append(args, "prefix", ks.Prefix, "site_id", site.ID)
+	if state := seriesLabel(site.State); state != "" {
+		args = append(args, "state", state)
+	}
+	if city := seriesLabel(site.City); city != "" {
+		args = append(args, "city", city)
+	}
+	return scripts.CreateSiteSeriesScript.Run(ctx, client, keys, args...).Err()
+}
+
+// seriesLabel lowercases a label value and joins its words with
+// underscores, so it can be matched by TS.MRANGE filters.
+func seriesLabel(v string) string {
+	return strings.Join(searchTerms(v), "_")
+}
+
 func (d *MetricDaoRedisTimeseries) Insert(ctx context.Context, reading models.MeterReading) error {
 	return d.InsertWithPipeline(ctx, reading, nil)
 }
@@ -48,10 +135,16 @@ func (d *MetricDaoRedisTimeseries) InsertWithPipeline(ctx context.Context, readi
 	return nil
 }
 
+// InsertMeasurementWithPipeline queues the write of a single measurement,
+// such as one copied from the other backend, on pipe.
+func (d *MetricDaoRedisTimeseries) InsertMeasurementWithPipeline(ctx context.Context, m models.Measurement, pipe goredis.Pipeliner) {
+	d.insertMetric(ctx, m.SiteID, m.Value, m.MetricUnit, measurementTime(m), pipe)
+}
+
 func (d *MetricDaoRedisTimeseries) insertMetric(ctx context.Context, siteID int, value float64, unit models.MetricUnit, t time.Time, pipe goredis.Pipeliner) {
 	key := d.KeySchema.TimeseriesKey(siteID, unit)
 	timeMs := unixMilliseconds(t)
-	pipe.Do(ctx, "TS.ADD", key, timeMs, value, "RETENTION", RetentionMS)
+	pipe.Do(ctx, "TS.ADD", key, timeMs, value, "RETENTION", RetentionMS, "ON_DUPLICATE", DuplicatePolicy)
 }
 
 func (d *MetricDaoRedisTimeseries) GetRecent(ctx context.Context, siteID int, unit models.MetricUnit, t time.Time, limit int) ([]models.Measurement, error) {
@@ -63,16 +156,70 @@ func (d *MetricDaoRedisTimeseries) GetRecent(ctx context.Context, siteID int, un
 	if err != nil {
 		return nil, err
 	}
+	return parseRange(result, siteID, unit, limit)
+}
+
+// GetRange returns the site's measurements of unit within q.From and q.To,
+// downsampled with TS.RANGE AGGREGATION when q.Bucket is set. At most
+// q.Limit measurements are returned, oldest first. Averages over whole
+// hours or days that reach back past the minute data's retention are read
+// from the hourly or daily compaction.
+func (d *MetricDaoRedisTimeseries) GetRange(ctx context.Context, siteID int, unit models.MetricUnit, q models.MetricRange) ([]models.Measurement, error) {
+	if q.Bucket > 0 && q.Aggregation == "" {
+		q.Aggregation = models.MetricAggAvg
+	}
+	key := d.KeySchema.TimeseriesKey(siteID, unit)
+	switch compactionBucket(q) {
+	case "day":
+		key = d.KeySchema.TimeseriesDayKey(siteID, unit)
+	case "hour":
+		key = d.KeySchema.TimeseriesHourKey(siteID, unit)
+	}
+
+	args := []interface{}{"TS.RANGE", key, unixMilliseconds(q.From), unixMilliseconds(q.To)}
+	if q.Limit > 0 {
+		args = append(args, "COUNT", q.Limit)
+	}
+	if q.Bucket > 0 {
+		args = append(args, "AGGREGATION", string(q.Aggregation), q.Bucket.Milliseconds())
+	}
+
+	result, err := d.Client.Do(ctx, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseRange(result, siteID, unit, q.Limit)
+}
+
+// compactionBucket returns the bucket label of the series q is best read
+// from: "day" or "hour" for averages over whole days or hours that reach
+// back past the minute data's retention, otherwise "raw".
+func compactionBucket(q models.MetricRange) string {
+	if q.Bucket <= 0 || q.Aggregation != CompactionAggregation ||
+		time.Since(q.From) <= time.Duration(RetentionMS)*time.Millisecond {
+		return "raw"
+	}
+	switch {
+	case q.Bucket%(24*time.Hour) == 0:
+		return "day"
+	case q.Bucket%time.Hour == 0:
+		return "hour"
+	default:
+		return "raw"
+	}
+}
 
+// parseRange reads up to limit measurements, or all of them if limit is 0,
+// from a TS.RANGE reply.
+func parseRange(result interface{}, siteID int, unit models.MetricUnit, limit int) ([]models.Measurement, error) {
 	pairs, ok := result.([]interface{})
 	if !ok {
 		return nil, fmt.Errorf("unexpected TS.RANGE result type: %T", result)
 	}
 
 	measurements := make([]models.Measurement, 0, len(pairs))
-	count := 0
 	for _, pair := range pairs {
-		if count >= limit {
+		if limit > 0 && len(measurements) >= limit {
 			break
 		}
 		p, ok := pair.([]interface{})
@@ -93,7 +240,6 @@ func (d *MetricDaoRedisTimeseries) GetRecent(ctx context.Context, siteID int, un
 			Timestamp:  float64(ts) / 1000.0,
 			Value:      val,
 		})
-		count++
 	}
 
 	return measurements, nil
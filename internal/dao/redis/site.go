@@ -2,12 +2,16 @@ package redis
 
 import (
 	"context"
+	"fmt"
 	"strconv"
+	"time"
 
 	goredis "github.com/redis/go-redis/v9"
 
 	"redisolar-go/internal/dao"
+	"redisolar-go/internal/keyschema"
 	"redisolar-go/internal/models"
+	"redisolar-go/internal/scripts"
 )
 
 type SiteDaoRedis struct {
@@ -18,10 +22,18 @@ func NewSiteDao(base RedisDao) *SiteDaoRedis {
 	return &SiteDaoRedis{RedisDao: base}
 }
 
+// Insert writes a site, replacing it if it exists. It goes through
+// InsertBatch so an existing site is removed from the indexes of its old
+// values.
 func (d *SiteDaoRedis) Insert(ctx context.Context, site models.Site) error {
-	return d.InsertWithClient(ctx, site, d.Client)
+	return d.InsertBatch(ctx, []models.Site{site}, d.InsertWithClient)[0]
 }
 
+// InsertWithClient writes the site hash, site indexes and ID, and creates
+// the site's timeseries when metrics are stored with RedisTimeSeries. On a
+// pipeline the series script must be preloaded with scripts.Preload. It
+// does not remove an existing site from the indexes of its old values, so
+// use it through InsertBatch to replace a site.
 func (d *SiteDaoRedis) InsertWithClient(ctx context.Context, site models.Site, client goredis.Cmdable) error {
 	hashKey := d.KeySchema.SiteHashKey(site.ID)
 	siteIDsKey := d.KeySchema.SiteIDsKey()
@@ -29,12 +41,68 @@ func (d *SiteDaoRedis) InsertWithClient(ctx context.Context, site models.Site, c
 	if err := client.HSet(ctx, hashKey, flat).Err(); err != nil {
 		return err
 	}
-	return client.SAdd(ctx, siteIDsKey, site.ID).Err()
+	indexSite(ctx, d.KeySchema, site, client)
+	if err := client.SAdd(ctx, siteIDsKey, site.ID).Err(); err != nil {
+		return err
+	}
+	if !d.usesTimeseries() {
+		return nil
+	}
+	return createSiteSeries(ctx, d.KeySchema, site, client)
+}
+
+// InsertBatch writes sites in a single pipeline through each of the given
+// insert functions, such as SiteDaoRedis.InsertWithClient and
+// SiteGeoDaoRedis.InsertWithClient, and returns one error per site. Sites
+// that already exist are first removed from the indexes of their old values.
+// A site whose ID appeared earlier in the batch is rejected.
+func (d *SiteDaoRedis) InsertBatch(ctx context.Context, sites []models.Site, inserts ...func(context.Context, models.Site, goredis.Cmdable) error) []error {
+	ids := make([]int, len(sites))
+	first := make(map[int]int, len(sites))
+	for i, site := range sites {
+		ids[i] = site.ID
+		if _, ok := first[site.ID]; !ok {
+			first[site.ID] = i
+		}
+	}
+	existing, err := findSites(ctx, d.RedisDao, ids, true)
+	if err != nil {
+		errs := make([]error, len(sites))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	old := make(map[int]models.Site, len(existing))
+	for _, site := range existing {
+		old[site.ID] = site
+	}
+
+	pipe := d.Client.Pipeline()
+	scripts.Preload(ctx, pipe)
+	return execEach(ctx, pipe, len(sites), func(i int) error {
+		if first[sites[i].ID] != i {
+			return fmt.Errorf("site %d appears earlier in this batch", sites[i].ID)
+		}
+		if site, ok := old[sites[i].ID]; ok {
+			unindexSite(ctx, d.KeySchema, site, pipe)
+		}
+		for _, insert := range inserts {
+			if err := insert(ctx, sites[i], pipe); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (d *SiteDaoRedis) InsertMany(ctx context.Context, sites ...models.Site) error {
-	for _, site := range sites {
-		if err := d.Insert(ctx, site); err != nil {
+	return firstError(d.InsertBatch(ctx, sites, d.InsertWithClient))
+}
+
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
 			return err
 		}
 	}
@@ -42,8 +110,11 @@ func (d *SiteDaoRedis) InsertMany(ctx context.Context, sites ...models.Site) err
 }
 
 func (d *SiteDaoRedis) FindByID(ctx context.Context, siteID int) (models.Site, error) {
-	hashKey := d.KeySchema.SiteHashKey(siteID)
-	result, err := d.Client.HGetAll(ctx, hashKey).Result()
+	return findSite(ctx, d.Client, d.KeySchema, siteID)
+}
+
+func findSite(ctx context.Context, client goredis.Cmdable, ks *keyschema.KeySchema, siteID int) (models.Site, error) {
+	result, err := client.HGetAll(ctx, ks.SiteHashKey(siteID)).Result()
 	if err != nil {
 		return models.Site{}, err
 	}
@@ -53,27 +124,198 @@ func (d *SiteDaoRedis) FindByID(ctx context.Context, siteID int) (models.Site, e
 	return models.SiteFromFlatMap(result)
 }
 
+// ExistsMany reports, for each of the given site IDs, whether the site is
+// registered in the site ID set.
+func (d *SiteDaoRedis) ExistsMany(ctx context.Context, siteIDs ...int) ([]bool, error) {
+	if len(siteIDs) == 0 {
+		return nil, nil
+	}
+	members := make([]interface{}, len(siteIDs))
+	for i, id := range siteIDs {
+		members[i] = id
+	}
+	return d.Client.SMIsMember(ctx, d.KeySchema.SiteIDsKey(), members...).Result()
+}
+
 func (d *SiteDaoRedis) FindAll(ctx context.Context) ([]models.Site, error) {
 	siteIDs, err := d.Client.SMembers(ctx, d.KeySchema.SiteIDsKey()).Result()
 	if err != nil {
 		return nil, err
 	}
+	return findSites(ctx, d.RedisDao, parseSiteIDs(siteIDs), false)
+}
 
+// List returns a page of sites matching query, and the cursor of the next
+// page or "" on the last one.
+func (d *SiteDaoRedis) List(ctx context.Context, query models.SiteQuery) ([]models.Site, string, error) {
+	return listSites(ctx, d.RedisDao, query)
+}
+
+// siteFetchChunk is how many site hashes are fetched per round trip.
+const siteFetchChunk = 500
+
+// findSites fetches the hashes of the given sites, in order, pipelining
+// them in chunks of siteFetchChunk. A malformed hash is an error, as is a
+// missing one unless skipMissing is set.
+func findSites(ctx context.Context, base RedisDao, siteIDs []int, skipMissing bool) ([]models.Site, error) {
 	sites := make([]models.Site, 0, len(siteIDs))
-	for _, idStr := range siteIDs {
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			continue
+	for start := 0; start < len(siteIDs); start += siteFetchChunk {
+		end := start + siteFetchChunk
+		if end > len(siteIDs) {
+			end = len(siteIDs)
 		}
-		result, err := d.Client.HGetAll(ctx, d.KeySchema.SiteHashKey(id)).Result()
-		if err != nil {
-			return nil, err
+
+		pipe := base.Client.Pipeline()
+		cmds := make([]*goredis.MapStringStringCmd, 0, end-start)
+		for _, id := range siteIDs[start:end] {
+			cmds = append(cmds, pipe.HGetAll(ctx, base.KeySchema.SiteHashKey(id)))
 		}
-		site, err := models.SiteFromFlatMap(result)
-		if err != nil {
+		if _, err := pipe.Exec(ctx); err != nil {
 			return nil, err
 		}
-		sites = append(sites, site)
+
+		for i, cmd := range cmds {
+			id := siteIDs[start+i]
+			result := cmd.Val()
+			if len(result) == 0 {
+				if skipMissing {
+					continue
+				}
+				return nil, fmt.Errorf("site %d: %w", id, dao.ErrSiteNotFound)
+			}
+			site, err := models.SiteFromFlatMap(result)
+			if err != nil {
+				return nil, fmt.Errorf("site %d: %w", id, err)
+			}
+			sites = append(sites, site)
+		}
 	}
 	return sites, nil
 }
+
+func parseSiteIDs(members []string) []int {
+	ids := make([]int, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.Atoi(m)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Update replaces a site's details, moving its geo point if the coordinate
+// changed. It returns dao.ErrSiteNotFound if the site does not exist.
+func (d *SiteDaoRedis) Update(ctx context.Context, site models.Site) error {
+	return updateSite(ctx, d.RedisDao, site)
+}
+
+// Delete removes a site and everything recorded for it. It returns
+// dao.ErrSiteNotFound if the site does not exist.
+func (d *SiteDaoRedis) Delete(ctx context.Context, siteID int) error {
+	return deleteSite(ctx, d.RedisDao, siteID)
+}
+
+// watchSite reads a site under WATCH and calls fn with it, retrying if the
+// site's hash changes before fn's transaction executes, so that an update
+// racing a delete cannot bring the deleted site back.
+func watchSite(ctx context.Context, base RedisDao, siteID int, fn func(tx *goredis.Tx, old models.Site) error) error {
+	for attempt := 0; attempt < maxWatchAttempts; attempt++ {
+		err := base.Client.Watch(ctx, func(tx *goredis.Tx) error {
+			old, err := findSite(ctx, tx, base.KeySchema, siteID)
+			if err != nil {
+				return err
+			}
+			return fn(tx, old)
+		}, base.KeySchema.SiteHashKey(siteID))
+		if err != goredis.TxFailedErr {
+			return err
+		}
+	}
+	return goredis.TxFailedErr
+}
+
+func updateSite(ctx context.Context, base RedisDao, site models.Site) error {
+	return watchSite(ctx, base, site.ID, func(tx *goredis.Tx, old models.Site) error {
+		// The series are relabelled before the transaction rather than in
+		// it, so if TS.CREATE or TS.ALTER fails the site is left unchanged.
+		if base.usesTimeseries() {
+			if err := createSiteSeries(ctx, base.KeySchema, site, tx); err != nil {
+				return err
+			}
+		}
+		return replaceSite(ctx, base, old, site, tx.TxPipeline())
+	})
+}
+
+func replaceSite(ctx context.Context, base RedisDao, old models.Site, site models.Site, pipe goredis.Pipeliner) error {
+	hashKey := base.KeySchema.SiteHashKey(site.ID)
+	unindexSite(ctx, base.KeySchema, old, pipe)
+	pipe.Del(ctx, hashKey)
+	pipe.HSet(ctx, hashKey, models.SiteToFlatMap(site))
+	pipe.SAdd(ctx, base.KeySchema.SiteIDsKey(), site.ID)
+	indexSite(ctx, base.KeySchema, site, pipe)
+	if site.Coordinate == nil {
+		pipe.ZRem(ctx, base.KeySchema.SiteGeoKey(), strconv.Itoa(site.ID))
+	} else {
+		pipe.GeoAdd(ctx, base.KeySchema.SiteGeoKey(), &goredis.GeoLocation{
+			Name:      strconv.Itoa(site.ID),
+			Longitude: site.Coordinate.Lng,
+			Latitude:  site.Coordinate.Lat,
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// deleteSite removes a site from the ID set, site indexes, geo index,
+// capacity ranking and capacity averages and drops its hash, feed,
+// timeseries, metrics and stats. Its entries in the global feed are left to
+// age out of the capped stream.
+func deleteSite(ctx context.Context, base RedisDao, siteID int) error {
+	return watchSite(ctx, base, siteID, func(tx *goredis.Tx, old models.Site) error {
+		return removeSite(ctx, base, siteID, old, tx.TxPipeline())
+	})
+}
+
+func removeSite(ctx context.Context, base RedisDao, siteID int, old models.Site, pipe goredis.Pipeliner) error {
+	ks := base.KeySchema
+	hashKey := ks.SiteHashKey(siteID)
+	member := strconv.Itoa(siteID)
+	keys := []string{hashKey, ks.FeedKey(siteID)}
+	for _, unit := range metricUnits {
+		keys = append(keys,
+			ks.TimeseriesKey(siteID, unit),
+			ks.TimeseriesHourKey(siteID, unit),
+			ks.TimeseriesDayKey(siteID, unit),
+		)
+	}
+	now := time.Now()
+	for day := 0; day <= MaxMetricRetentionDays; day++ {
+		t := now.AddDate(0, 0, -day)
+		for _, unit := range metricUnits {
+			keys = append(keys, ks.DayMetricKey(siteID, unit, t))
+		}
+		if day <= WeekSeconds/(60*60*24) {
+			keys = append(keys, ks.SiteStatsKey(siteID, t))
+		}
+	}
+
+	pipe.SRem(ctx, ks.SiteIDsKey(), siteID)
+	unindexSite(ctx, ks, old, pipe)
+	pipe.ZRem(ctx, ks.SiteGeoKey(), member)
+	pipe.ZRem(ctx, ks.CapacityRankingKey(), member)
+	pipe.ZRem(ctx, ks.CapacityAverageKey(), member)
+	for h := time.Duration(0); h <= CapacityHourRetention; h += time.Hour {
+		pipe.ZRem(ctx, ks.CapacityHourKey(now.Add(-h)), member)
+		pipe.ZRem(ctx, ks.CapacityHourCountKey(now.Add(-h)), member)
+	}
+	for day := time.Duration(0); day <= CapacityDayRetention; day += 24 * time.Hour {
+		pipe.ZRem(ctx, ks.CapacityDayKey(now.Add(-day)), member)
+		pipe.ZRem(ctx, ks.CapacityDayCountKey(now.Add(-day)), member)
+	}
+	pipe.Del(ctx, keys...)
+	_, err := pipe.Exec(ctx)
+	return err
+}
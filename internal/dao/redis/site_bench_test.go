@@ -0,0 +1,165 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/config"
+	"redisolar-go/internal/keyschema"
+	"redisolar-go/internal/models"
+)
+
+var benchSiteCounts = []int{100, 1000, 10000}
+
+// maxPerSiteGrowth is how much slower per site a lookup over the most sites
+// may be than one over the fewest before the benchmark fails.
+const maxPerSiteGrowth = 3.0
+
+// roundTrips counts the commands and pipelines a client sends, each of
+// which is one round trip.
+type roundTrips struct{ n atomic.Int64 }
+
+func (r *roundTrips) DialHook(next goredis.DialHook) goredis.DialHook { return next }
+
+func (r *roundTrips) ProcessHook(next goredis.ProcessHook) goredis.ProcessHook {
+	return func(ctx context.Context, cmd goredis.Cmder) error {
+		r.n.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (r *roundTrips) ProcessPipelineHook(next goredis.ProcessPipelineHook) goredis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []goredis.Cmder) error {
+		r.n.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+// benchLookup runs lookup as a sub-benchmark for each of benchSiteCounts,
+// reporting its round trips and time per site. It fails if a lookup takes
+// more round trips than one per siteFetchChunk sites plus extra, or if the
+// time per site grows more than maxPerSiteGrowth times from the fewest
+// sites to the most, so the latency per site stays flat.
+func benchLookup(b *testing.B, base RedisDao, extra int64, lookup func(ctx context.Context) ([]models.Site, error)) {
+	ctx := context.Background()
+	trips := &roundTrips{}
+	base.Client.AddHook(trips)
+
+	perSite := make(map[int]float64, len(benchSiteCounts))
+	for _, n := range benchSiteCounts {
+		seedSites(b, base, n)
+		b.Run(fmt.Sprintf("sites=%d", n), func(b *testing.B) {
+			trips.n.Store(0)
+			for i := 0; i < b.N; i++ {
+				sites, err := lookup(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(sites) != n {
+					b.Fatalf("got %d sites, want %d", len(sites), n)
+				}
+			}
+			got := float64(trips.n.Load()) / float64(b.N)
+			want := float64((n+siteFetchChunk-1)/siteFetchChunk) + float64(extra)
+			b.ReportMetric(got, "roundtrips/op")
+			if got > want {
+				b.Errorf("%.1f round trips per lookup of %d sites, want at most %.0f", got, n, want)
+			}
+			perSite[n] = float64(b.Elapsed()) / float64(b.N*n)
+			b.ReportMetric(perSite[n], "ns/site")
+		})
+	}
+
+	fewest, most := benchSiteCounts[0], benchSiteCounts[len(benchSiteCounts)-1]
+	if perSite[fewest] > 0 && perSite[most] > maxPerSiteGrowth*perSite[fewest] {
+		b.Errorf("%v per site with %d sites, %v with %d: more than %.0fx slower",
+			time.Duration(perSite[most]), most, time.Duration(perSite[fewest]), fewest, maxPerSiteGrowth)
+	}
+}
+
+// benchDao connects to the Redis at config.TestRedisAddr, using the test
+// key prefix, and skips the benchmark if none is set or it is unreachable.
+// Keys with the test prefix are deleted when the benchmark finishes. Metrics
+// use the zset backend, so seeding sites needs no RedisTimeSeries.
+func benchDao(b *testing.B) RedisDao {
+	addr := config.TestRedisAddr()
+	if addr == "" {
+		b.Skip("REDIS_TEST_ADDR not set")
+	}
+	cfg := config.Load()
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     addr,
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+	})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		b.Skipf("Redis not available: %v", err)
+	}
+
+	ks := keyschema.New(keyschema.DefaultKeyPrefix)
+	b.Cleanup(func() {
+		iter := client.Scan(ctx, 0, ks.Prefix+":*", 1000).Iterator()
+		for iter.Next(ctx) {
+			client.Del(ctx, iter.Val())
+		}
+		client.Close()
+	})
+	base := NewRedisDao(client, ks)
+	base.MetricBackend = MetricBackendZSet
+	return base
+}
+
+func seedSites(b *testing.B, base RedisDao, n int) {
+	ctx := context.Background()
+	siteDao := NewSiteDao(base)
+	geoDao := NewSiteGeoDao(base)
+	sites := make([]models.Site, n)
+	for i := range sites {
+		sites[i] = models.Site{
+			ID:         i + 1,
+			Capacity:   4.5,
+			Panels:     3,
+			Address:    fmt.Sprintf("%d Main St.", i+1),
+			City:       "Oakland",
+			State:      "CA",
+			PostalCode: "94577",
+			Coordinate: &models.Coordinate{
+				Lat: 37.7 + float64(i%100)*0.001,
+				Lng: -122.2 + float64(i/100)*0.001,
+			},
+		}
+	}
+	for _, err := range siteDao.InsertBatch(ctx, sites, siteDao.InsertWithClient, geoDao.InsertWithClient) {
+		if err != nil {
+			b.Fatalf("seeding sites: %v", err)
+		}
+	}
+}
+
+func BenchmarkSiteDaoRedis_FindAll(b *testing.B) {
+	base := benchDao(b)
+	siteDao := NewSiteDao(base)
+	// One SMEMBERS, then one pipeline per chunk.
+	benchLookup(b, base, 1, siteDao.FindAll)
+}
+
+func BenchmarkSiteGeoDaoRedis_FindByGeo(b *testing.B) {
+	base := benchDao(b)
+	geoDao := NewSiteGeoDao(base)
+	query := models.GeoQuery{
+		Coordinate: models.Coordinate{Lat: 37.7, Lng: -122.2},
+		Radius:     100,
+		RadiusUnit: models.GeoUnitKM,
+	}
+	// One GEOSEARCH, then one pipeline per chunk.
+	benchLookup(b, base, 1, func(ctx context.Context) ([]models.Site, error) {
+		return geoDao.FindByGeo(ctx, query)
+	})
+}
@@ -0,0 +1,169 @@
+package redis
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/models"
+)
+
+// MaxClusterPrecision is the longest geohash FindClusters groups sites by.
+const MaxClusterPrecision = 12
+
+// FindClusters groups the sites matching query by the geohash cell of the
+// given precision (1 to MaxClusterPrecision characters) they fall in, and
+// aggregates each cell's site count, installed capacity and current
+// capacity. Clusters are returned in geohash order.
+func (d *SiteGeoDaoRedis) FindClusters(ctx context.Context, query models.GeoQuery, precision int) ([]models.SiteCluster, error) {
+	if precision < 1 {
+		precision = 1
+	}
+	if precision > MaxClusterPrecision {
+		precision = MaxClusterPrecision
+	}
+
+	query.Count = 0
+	locations, err := geoSearch(ctx, d.RedisDao, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(locations) == 0 {
+		return []models.SiteCluster{}, nil
+	}
+
+	// Installed capacity comes from the site capacity index and current
+	// capacity from the ranking, so most site hashes are not read. ZMSCORE
+	// is sent raw because the typed command reports missing members as 0.
+	members := make([]interface{}, len(locations))
+	for i, loc := range locations {
+		members[i] = loc.Name
+	}
+	pipe := d.Client.Pipeline()
+	installedCmd := pipe.Do(ctx, append([]interface{}{"ZMSCORE",
+		d.KeySchema.SiteRangeIndexKey(models.SiteFieldCapacity)}, members...)...)
+	currentCmd := pipe.Do(ctx, append([]interface{}{"ZMSCORE",
+		d.KeySchema.CapacityRankingKey()}, members...)...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	installed, _ := installedCmd.Slice()
+	current, _ := currentCmd.Slice()
+	capacities, err := d.installedCapacities(ctx, locations, installed)
+	if err != nil {
+		return nil, err
+	}
+
+	cells := make(map[string]*models.SiteCluster)
+	currentTotals := make(map[string]float64)
+	for i, loc := range locations {
+		hash := geohash(loc.Latitude, loc.Longitude, precision)
+		cell, ok := cells[hash]
+		if !ok {
+			cell = &models.SiteCluster{GeoHash: hash}
+			cells[hash] = cell
+		}
+		cell.Count++
+		cell.Center.Lat += loc.Latitude
+		cell.Center.Lng += loc.Longitude
+		cell.TotalCapacity += capacities[i]
+		if i < len(current) {
+			if v, ok := parseScore(current[i]); ok {
+				cell.Reporting++
+				currentTotals[hash] += v
+			}
+		}
+	}
+
+	clusters := make([]models.SiteCluster, 0, len(cells))
+	for hash, cell := range cells {
+		cell.Center.Lat /= float64(cell.Count)
+		cell.Center.Lng /= float64(cell.Count)
+		if cell.Reporting > 0 {
+			cell.AverageCurrentCapacity = currentTotals[hash] / float64(cell.Reporting)
+		}
+		clusters = append(clusters, *cell)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].GeoHash < clusters[j].GeoHash })
+	return clusters, nil
+}
+
+// installedCapacities returns the installed capacity of each site at
+// locations, from its score in the capacity index or, for sites written
+// before the index existed, from its hash.
+func (d *SiteGeoDaoRedis) installedCapacities(ctx context.Context, locations []goredis.GeoLocation, scores []interface{}) ([]float64, error) {
+	capacities := make([]float64, len(locations))
+	missing := make(map[int]*goredis.StringCmd)
+	pipe := d.Client.Pipeline()
+	for i, loc := range locations {
+		if i < len(scores) {
+			if v, ok := parseScore(scores[i]); ok {
+				capacities[i] = v
+				continue
+			}
+		}
+		id, err := strconv.Atoi(loc.Name)
+		if err != nil {
+			continue
+		}
+		missing[i] = pipe.HGet(ctx, d.KeySchema.SiteHashKey(id), models.SiteFieldCapacity)
+	}
+	if len(missing) == 0 {
+		return capacities, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != goredis.Nil {
+		return nil, err
+	}
+	for i, cmd := range missing {
+		capacities[i], _ = cmd.Float64()
+	}
+	return capacities, nil
+}
+
+// parseScore reads a score from a raw reply: a string under RESP2, a
+// float64 under RESP3, or nil for a missing member.
+func parseScore(v interface{}) (float64, bool) {
+	switch s := v.(type) {
+	case float64:
+		return s, true
+	case string:
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash returns the standard base32 geohash of a point with the given
+// number of characters.
+func geohash(lat, lng float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	even := true // geohash bits start with longitude
+	bit, ch := 0, 0
+	for len(hash) < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lngRange, lng
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
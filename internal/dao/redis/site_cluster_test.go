@@ -0,0 +1,22 @@
+package redis
+
+import "testing"
+
+func TestGeohash(t *testing.T) {
+	tests := []struct {
+		lat, lng  float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{42.6, -5.6, 5, "ezs42"},
+		{37.715732, -122.027342, 1, "9"},
+		{-90, -180, 3, "000"},
+	}
+
+	for _, tt := range tests {
+		if got := geohash(tt.lat, tt.lng, tt.precision); got != tt.want {
+			t.Errorf("geohash(%v, %v, %d) = %q, want %q", tt.lat, tt.lng, tt.precision, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package redis
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"strconv"
 
 	goredis "github.com/redis/go-redis/v9"
@@ -10,14 +12,20 @@ import (
 	"redisolar-go/internal/models"
 )
 
+// CapacityThreshold is the default capacity above which a site has excess
+// capacity.
 const CapacityThreshold = 0.2
 
 type SiteGeoDaoRedis struct {
 	RedisDao
+
+	// ExcessCapacityThreshold is the capacity above which
+	// GeoQuery.OnlyExcessCapacity keeps a site.
+	ExcessCapacityThreshold float64
 }
 
 func NewSiteGeoDao(base RedisDao) *SiteGeoDaoRedis {
-	return &SiteGeoDaoRedis{RedisDao: base}
+	return &SiteGeoDaoRedis{RedisDao: base, ExcessCapacityThreshold: CapacityThreshold}
 }
 
 func (d *SiteGeoDaoRedis) Insert(ctx context.Context, site models.Site) error {
@@ -63,132 +71,206 @@ func (d *SiteGeoDaoRedis) FindByID(ctx context.Context, siteID int) (models.Site
 	return models.SiteFromFlatMap(result)
 }
 
-func (d *SiteGeoDaoRedis) FindByGeo(ctx context.Context, query models.GeoQuery) ([]models.Site, error) {
-	if query.OnlyExcessCapacity {
-		return d.findByGeoWithCapacity(ctx, query)
-	}
-	return d.findByGeo(ctx, query)
+// List returns a page of sites matching query, and the cursor of the next
+// page or "" on the last one.
+func (d *SiteGeoDaoRedis) List(ctx context.Context, query models.SiteQuery) ([]models.Site, string, error) {
+	return listSites(ctx, d.RedisDao, query)
 }
 
-func (d *SiteGeoDaoRedis) findByGeo(ctx context.Context, query models.GeoQuery) ([]models.Site, error) {
-	locations, err := d.Client.GeoRadius(ctx, d.KeySchema.SiteGeoKey(),
-		query.Coordinate.Lng, query.Coordinate.Lat,
-		&goredis.GeoRadiusQuery{
-			Radius: query.Radius,
-			Unit:   string(query.RadiusUnit),
-		}).Result()
+func (d *SiteGeoDaoRedis) FindByGeo(ctx context.Context, query models.GeoQuery) ([]models.Site, error) {
+	found, err := d.FindNearby(ctx, query)
 	if err != nil {
 		return nil, err
 	}
-
-	sites := make([]models.Site, 0, len(locations))
-	for _, loc := range locations {
-		id, err := strconv.Atoi(loc.Name)
-		if err != nil {
-			continue
-		}
-		result, err := d.Client.HGetAll(ctx, d.KeySchema.SiteHashKey(id)).Result()
-		if err != nil {
-			return nil, err
-		}
-		site, err := models.SiteFromFlatMap(result)
-		if err != nil {
-			return nil, err
-		}
-		sites = append(sites, site)
+	sites := make([]models.Site, len(found))
+	for i, f := range found {
+		sites[i] = f.Site
 	}
 	return sites, nil
 }
 
-func (d *SiteGeoDaoRedis) findByGeoWithCapacity(ctx context.Context, query models.GeoQuery) ([]models.Site, error) {
-	locations, err := d.Client.GeoRadius(ctx, d.KeySchema.SiteGeoKey(),
-		query.Coordinate.Lng, query.Coordinate.Lat,
-		&goredis.GeoRadiusQuery{
-			Radius: query.Radius,
-			Unit:   string(query.RadiusUnit),
-		}).Result()
+// FindNearby returns the sites matching query with their distance from the
+// query point, in the order GEOSEARCH returns them.
+func (d *SiteGeoDaoRedis) FindNearby(ctx context.Context, query models.GeoQuery) ([]models.GeoSite, error) {
+	var locations []goredis.GeoLocation
+	var err error
+	if min, max, ok := d.capacityRange(query); ok {
+		locations, err = d.geoSearchByCapacity(ctx, query, min, max)
+	} else {
+		locations, err = geoSearch(ctx, d.RedisDao, query)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return geoSites(ctx, d.RedisDao, locations)
+}
 
+// capacityRange returns the ZRANGEBYSCORE bounds of the query's capacity
+// filter, and false if it has none.
+func (d *SiteGeoDaoRedis) capacityRange(query models.GeoQuery) (string, string, bool) {
+	min, max := "-inf", "+inf"
+	if query.OnlyExcessCapacity {
+		min = "(" + strconv.FormatFloat(d.ExcessCapacityThreshold, 'f', -1, 64)
+	}
+	if query.MinCapacity != nil {
+		min = strconv.FormatFloat(*query.MinCapacity, 'f', -1, 64)
+	}
+	if query.MaxCapacity != nil {
+		max = strconv.FormatFloat(*query.MaxCapacity, 'f', -1, 64)
+	}
+	return min, max, min != "-inf" || max != "+inf"
+}
+
+// geoSearchByCapacity runs the geo query and the capacity filter in one
+// transaction: GEOSEARCHSTORE keeps the matches scored by distance,
+// ZINTERSTORE scores them by capacity instead so ZRANGESTORE can keep those
+// in range, and a second ZINTERSTORE brings back their distances. COUNT is
+// applied last, so it returns the nearest sites that pass the filter.
+func (d *SiteGeoDaoRedis) geoSearchByCapacity(ctx context.Context, query models.GeoQuery, min, max string) ([]goredis.GeoLocation, error) {
 	capacityKey := d.KeySchema.CapacityRankingKey()
-	pipe := d.Client.Pipeline()
-	cmds := make([]*goredis.FloatCmd, len(locations))
-	for i, loc := range locations {
-		cmds[i] = pipe.ZScore(ctx, capacityKey, loc.Name)
+	if query.CapacityMetric == models.CapacityAverage {
+		capacityKey = d.KeySchema.CapacityAverageKey()
 	}
-	_, _ = pipe.Exec(ctx)
 
-	// Collect site IDs with capacity above threshold
-	var filteredIDs []int
-	for i, loc := range locations {
-		score, err := cmds[i].Result()
-		if err != nil {
-			continue
-		}
-		if score > CapacityThreshold {
-			id, err := strconv.Atoi(loc.Name)
-			if err != nil {
-				continue
-			}
-			filteredIDs = append(filteredIDs, id)
-		}
+	id := tempID()
+	geoKey := d.KeySchema.TempKey("geo:" + id)
+	scoredKey := d.KeySchema.TempKey("geo:" + id + ":capacity")
+	matchKey := d.KeySchema.TempKey("geo:" + id + ":match")
+
+	search := geoSearchQuery(query)
+	search.Count = 0
+	search.Sort = ""
+
+	pipe := d.Client.TxPipeline()
+	pipe.GeoSearchStore(ctx, d.KeySchema.SiteGeoKey(), geoKey, &goredis.GeoSearchStoreQuery{
+		GeoSearchQuery: search,
+		StoreDist:      true,
+	})
+	pipe.ZInterStore(ctx, scoredKey, &goredis.ZStore{
+		Keys:    []string{geoKey, capacityKey},
+		Weights: []float64{0, 1},
+	})
+	pipe.ZRangeStore(ctx, matchKey, goredis.ZRangeArgs{
+		Key:     scoredKey,
+		Start:   min,
+		Stop:    max,
+		ByScore: true,
+	})
+	pipe.ZInterStore(ctx, geoKey, &goredis.ZStore{
+		Keys:    []string{geoKey, matchKey},
+		Weights: []float64{1, 0},
+	})
+	stop := int64(-1)
+	if query.Count > 0 {
+		stop = int64(query.Count - 1)
+	}
+	var results *goredis.ZSliceCmd
+	if query.Sort == models.GeoSortDesc {
+		results = pipe.ZRevRangeWithScores(ctx, geoKey, 0, stop)
+	} else {
+		results = pipe.ZRangeWithScores(ctx, geoKey, 0, stop)
+	}
+	pipe.Del(ctx, geoKey, scoredKey, matchKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
 	}
 
-	// Fetch site hashes with pipeline
-	pipe2 := d.Client.Pipeline()
-	hashCmds := make([]*goredis.MapStringStringCmd, len(filteredIDs))
-	for i, id := range filteredIDs {
-		hashCmds[i] = pipe2.HGetAll(ctx, d.KeySchema.SiteHashKey(id))
+	locations := make([]goredis.GeoLocation, 0, len(results.Val()))
+	for _, z := range results.Val() {
+		name, _ := z.Member.(string)
+		locations = append(locations, goredis.GeoLocation{Name: name, Dist: z.Score})
 	}
-	_, _ = pipe2.Exec(ctx)
+	return locations, nil
+}
 
-	sites := make([]models.Site, 0, len(filteredIDs))
-	for _, cmd := range hashCmds {
-		result, err := cmd.Result()
-		if err != nil || len(result) == 0 {
-			continue
-		}
-		site, err := models.SiteFromFlatMap(result)
-		if err != nil {
-			continue
-		}
-		sites = append(sites, site)
+func tempID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// geoSearch runs GEOSEARCH for query, with the distance and indexed
+// coordinates of each location.
+func geoSearch(ctx context.Context, base RedisDao, query models.GeoQuery) ([]goredis.GeoLocation, error) {
+	return base.Client.GeoSearchLocation(ctx, base.KeySchema.SiteGeoKey(), &goredis.GeoSearchLocationQuery{
+		GeoSearchQuery: geoSearchQuery(query),
+		WithCoord:      true,
+		WithDist:       true,
+	}).Result()
+}
+
+func geoSearchQuery(query models.GeoQuery) goredis.GeoSearchQuery {
+	search := goredis.GeoSearchQuery{
+		Longitude: query.Coordinate.Lng,
+		Latitude:  query.Coordinate.Lat,
+		Sort:      string(query.Sort),
+		Count:     query.Count,
 	}
-	return sites, nil
+	if query.IsBox() {
+		search.BoxWidth = query.BoxWidth
+		search.BoxHeight = query.BoxHeight
+		search.BoxUnit = string(query.RadiusUnit)
+	} else {
+		search.Radius = query.Radius
+		search.RadiusUnit = string(query.RadiusUnit)
+	}
+	// Without an order, COUNT would return any N matches, not the nearest.
+	if search.Count > 0 && search.Sort == "" {
+		search.Sort = string(models.GeoSortAsc)
+	}
+	return search
 }
 
-func (d *SiteGeoDaoRedis) FindAll(ctx context.Context) ([]models.Site, error) {
-	siteIDs, err := d.Client.ZRange(ctx, d.KeySchema.SiteGeoKey(), 0, -1).Result()
+// geoSites fetches the sites at locations, keeping their order.
+func geoSites(ctx context.Context, base RedisDao, locations []goredis.GeoLocation) ([]models.GeoSite, error) {
+	names := make([]string, len(locations))
+	for i, loc := range locations {
+		names[i] = loc.Name
+	}
+	sites, err := findSites(ctx, base, parseSiteIDs(names), false)
 	if err != nil {
 		return nil, err
 	}
-
-	pipe := d.Client.Pipeline()
-	cmds := make([]*goredis.MapStringStringCmd, len(siteIDs))
-	for i, idStr := range siteIDs {
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			continue
-		}
-		cmds[i] = pipe.HGetAll(ctx, d.KeySchema.SiteHashKey(id))
+	byID := make(map[int]models.Site, len(sites))
+	for _, site := range sites {
+		byID[site.ID] = site
 	}
-	_, _ = pipe.Exec(ctx)
 
-	sites := make([]models.Site, 0, len(siteIDs))
-	for _, cmd := range cmds {
-		if cmd == nil {
+	found := make([]models.GeoSite, 0, len(sites))
+	for _, loc := range locations {
+		id, err := strconv.Atoi(loc.Name)
+		if err != nil {
 			continue
 		}
-		result, err := cmd.Result()
-		if err != nil || len(result) == 0 {
+		site, ok := byID[id]
+		if !ok {
 			continue
 		}
-		site, err := models.SiteFromFlatMap(result)
-		if err != nil {
-			continue
+		if site.Coordinate == nil && (loc.Latitude != 0 || loc.Longitude != 0) {
+			site.Coordinate = &models.Coordinate{Lat: loc.Latitude, Lng: loc.Longitude}
 		}
-		sites = append(sites, site)
+		found = append(found, models.GeoSite{Site: site, Distance: loc.Dist})
 	}
-	return sites, nil
+	return found, nil
+}
+
+func (d *SiteGeoDaoRedis) FindAll(ctx context.Context) ([]models.Site, error) {
+	siteIDs, err := d.Client.ZRange(ctx, d.KeySchema.SiteGeoKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return findSites(ctx, d.RedisDao, parseSiteIDs(siteIDs), false)
+}
+
+// Update replaces a site's details, moving its geo point if the coordinate
+// changed. It returns dao.ErrSiteNotFound if the site does not exist.
+func (d *SiteGeoDaoRedis) Update(ctx context.Context, site models.Site) error {
+	return updateSite(ctx, d.RedisDao, site)
+}
+
+// Delete removes a site and everything recorded for it. It returns
+// dao.ErrSiteNotFound if the site does not exist.
+func (d *SiteGeoDaoRedis) Delete(ctx context.Context, siteID int) error {
+	return deleteSite(ctx, d.RedisDao, siteID)
 }
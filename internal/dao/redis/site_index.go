@@ -0,0 +1,371 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/dao"
+	"redisolar-go/internal/keyschema"
+	"redisolar-go/internal/models"
+)
+
+// Sites are indexed by state, city and postal code in one set per value,
+// and by ID, capacity and panel count in one sorted set per field, so
+// listings can be filtered and paged without reading every site hash.
+
+// siteIndexValue normalizes a field value for the site indexes, so filters
+// match regardless of case and surrounding whitespace.
+func siteIndexValue(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+func siteIndexKeys(ks *keyschema.KeySchema, site models.Site) []string {
+	var keys []string
+	for field, value := range map[string]string{
+		models.SiteFieldState:      site.State,
+		models.SiteFieldCity:       site.City,
+		models.SiteFieldPostalCode: site.PostalCode,
+	} {
+		if v := siteIndexValue(value); v != "" {
+			keys = append(keys, ks.SiteIndexKey(field, v))
+		}
+	}
+	return keys
+}
+
+func indexSite(ctx context.Context, ks *keyschema.KeySchema, site models.Site, client goredis.Cmdable) {
+	for _, key := range siteIndexKeys(ks, site) {
+		client.SAdd(ctx, key, site.ID)
+	}
+	member := strconv.Itoa(site.ID)
+	client.ZAdd(ctx, ks.SiteRangeIndexKey(models.SiteFieldID), goredis.Z{Score: float64(site.ID), Member: member})
+	client.ZAdd(ctx, ks.SiteRangeIndexKey(models.SiteFieldCapacity), goredis.Z{Score: site.Capacity, Member: member})
+	client.ZAdd(ctx, ks.SiteRangeIndexKey(models.SiteFieldPanels), goredis.Z{Score: float64(site.Panels), Member: member})
+}
+
+func unindexSite(ctx context.Context, ks *keyschema.KeySchema, site models.Site, client goredis.Cmdable) {
+	for _, key := range siteIndexKeys(ks, site) {
+		client.SRem(ctx, key, site.ID)
+	}
+	member := strconv.Itoa(site.ID)
+	client.ZRem(ctx, ks.SiteRangeIndexKey(models.SiteFieldID), member)
+	client.ZRem(ctx, ks.SiteRangeIndexKey(models.SiteFieldCapacity), member)
+	client.ZRem(ctx, ks.SiteRangeIndexKey(models.SiteFieldPanels), member)
+}
+
+// Reindex writes the indexes of every registered site, and the location
+// field RediSearch reads from its hash, pipelining them in chunks of
+// siteFetchChunk, for sites written before these existed. It returns how
+// many sites were indexed.
+func (d *SiteDaoRedis) Reindex(ctx context.Context) (int, error) {
+	sites, err := d.FindAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for start := 0; start < len(sites); start += siteFetchChunk {
+		end := start + siteFetchChunk
+		if end > len(sites) {
+			end = len(sites)
+		}
+		pipe := d.Client.Pipeline()
+		for _, site := range sites[start:end] {
+			indexSite(ctx, d.KeySchema, site, pipe)
+			if location, ok := models.SiteToFlatMap(site)[models.SiteFieldLocation]; ok {
+				pipe.HSet(ctx, d.KeySchema.SiteHashKey(site.ID), models.SiteFieldLocation, location)
+			}
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return start, err
+		}
+	}
+	return len(sites), nil
+}
+
+// siteSortKey is a site's position in a listing.
+type siteSortKey struct {
+	id    int
+	value float64 // the site's score in the sort index
+}
+
+// listSites returns the page of sites matching query and the cursor of the
+// next page, which is empty on the last page. The page is read in order
+// from the sorted set of site IDs, or of capacities when sorting by
+// capacity, starting after the cursor, and the other filters are checked a
+// chunk at a time against the site indexes. Only the hashes of the sites
+// on the page are read. Sites with the same capacity are listed in the
+// order Redis keeps them, by the ID's string.
+func listSites(ctx context.Context, base RedisDao, query models.SiteQuery) ([]models.Site, string, error) {
+	ks := base.KeySchema
+	byCapacity := query.Sort == models.SiteSortCapacity
+	sortKey := ks.SiteRangeIndexKey(models.SiteFieldID)
+	var minScore, maxScore *float64
+	if byCapacity {
+		sortKey = ks.SiteRangeIndexKey(models.SiteFieldCapacity)
+		minScore, maxScore = query.MinCapacity, query.MaxCapacity
+	}
+
+	start, err := listStart(ctx, base, sortKey, query, minScore, maxScore)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// One more site than the page holds tells whether there is a next page.
+	want := query.Limit + 1
+	var page []siteSortKey
+	for query.Limit <= 0 || len(page) < want {
+		stop := start + siteFetchChunk - 1
+		var chunk []goredis.Z
+		if query.Descending {
+			chunk, err = base.Client.ZRevRangeWithScores(ctx, sortKey, start, stop).Result()
+		} else {
+			chunk, err = base.Client.ZRangeWithScores(ctx, sortKey, start, stop).Result()
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		start += int64(len(chunk))
+
+		// The index is read past the end of the sort bound only within
+		// the last chunk.
+		inRange := len(chunk)
+		for i, z := range chunk {
+			if (query.Descending && minScore != nil && z.Score < *minScore) ||
+				(!query.Descending && maxScore != nil && z.Score > *maxScore) {
+				inRange = i
+				break
+			}
+		}
+		chunk = chunk[:inRange]
+
+		keep, err := matchSites(ctx, base, query, byCapacity, chunk)
+		if err != nil {
+			return nil, "", err
+		}
+		for i, z := range chunk {
+			if !keep[i] {
+				continue
+			}
+			id, err := strconv.Atoi(z.Member.(string))
+			if err != nil {
+				continue
+			}
+			page = append(page, siteSortKey{id: id, value: z.Score})
+			if query.Limit > 0 && len(page) == want {
+				break
+			}
+		}
+		if inRange < siteFetchChunk {
+			break
+		}
+	}
+
+	next := ""
+	if query.Limit > 0 && len(page) > query.Limit {
+		page = page[:query.Limit]
+		next = formatSiteCursor(page[len(page)-1], byCapacity)
+	}
+
+	ids := make([]int, len(page))
+	for i, k := range page {
+		ids[i] = k.id
+	}
+	sites, err := findSites(ctx, base, ids, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return sites, next, nil
+}
+
+// listStart returns the rank in sortKey, counted from the end when the
+// listing is descending, of the first site a page may start at: the first
+// site after the cursor, and within the sort index's bounds. If the cursor's
+// site has since moved or gone, the page starts after every site with the
+// cursor's score.
+func listStart(ctx context.Context, base RedisDao, sortKey string, query models.SiteQuery, minScore, maxScore *float64) (int64, error) {
+	pipe := base.Client.Pipeline()
+	var skipped *goredis.IntCmd
+	switch {
+	case query.Descending && maxScore != nil:
+		skipped = pipe.ZCount(ctx, sortKey, "("+scoreBound(maxScore, ""), "+inf")
+	case !query.Descending && minScore != nil:
+		skipped = pipe.ZCount(ctx, sortKey, "-inf", "("+scoreBound(minScore, ""))
+	}
+
+	var after siteSortKey
+	var rank, passed *goredis.IntCmd
+	var score *goredis.FloatCmd
+	if query.Cursor != "" {
+		var err error
+		after, err = parseSiteCursor(query.Cursor, query.Sort == models.SiteSortCapacity)
+		if err != nil {
+			return 0, err
+		}
+		if query.Sort != models.SiteSortCapacity {
+			after.value = float64(after.id)
+		}
+		member := strconv.Itoa(after.id)
+		value := scoreBound(&after.value, "")
+		if query.Descending {
+			rank = pipe.ZRevRank(ctx, sortKey, member)
+			passed = pipe.ZCount(ctx, sortKey, value, "+inf")
+		} else {
+			rank = pipe.ZRank(ctx, sortKey, member)
+			passed = pipe.ZCount(ctx, sortKey, "-inf", value)
+		}
+		score = pipe.ZScore(ctx, sortKey, member)
+	}
+
+	if pipe.Len() == 0 {
+		return 0, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != goredis.Nil {
+		return 0, err
+	}
+
+	var start int64
+	if skipped != nil {
+		start = skipped.Val()
+	}
+	if query.Cursor != "" {
+		next := passed.Val()
+		if rank.Err() == nil && score.Err() == nil && score.Val() == after.value {
+			next = rank.Val() + 1
+		}
+		if next > start {
+			start = next
+		}
+	}
+	return start, nil
+}
+
+// matchSites reports which sites of a chunk of the sort index match the
+// query's filters other than the sort index's own bounds. Scores are read
+// with raw ZMSCORE because the typed command reports missing members as 0.
+func matchSites(ctx context.Context, base RedisDao, query models.SiteQuery, byCapacity bool, chunk []goredis.Z) ([]bool, error) {
+	keep := make([]bool, len(chunk))
+	for i := range keep {
+		keep[i] = true
+	}
+	if len(chunk) == 0 {
+		return keep, nil
+	}
+	members := make([]interface{}, len(chunk))
+	for i, z := range chunk {
+		members[i] = z.Member
+	}
+
+	ks := base.KeySchema
+	pipe := base.Client.Pipeline()
+	var sets []*goredis.BoolSliceCmd
+	for field, value := range map[string]string{
+		models.SiteFieldState:      query.State,
+		models.SiteFieldCity:       query.City,
+		models.SiteFieldPostalCode: query.PostalCode,
+	} {
+		if v := siteIndexValue(value); v != "" {
+			sets = append(sets, pipe.SMIsMember(ctx, ks.SiteIndexKey(field, v), members...))
+		}
+	}
+
+	type scoreFilter struct {
+		cmd      *goredis.Cmd
+		min, max *float64
+	}
+	var ranges []scoreFilter
+	if !byCapacity && (query.MinCapacity != nil || query.MaxCapacity != nil) {
+		ranges = append(ranges, scoreFilter{
+			cmd: pipe.Do(ctx, append([]interface{}{"ZMSCORE", ks.SiteRangeIndexKey(models.SiteFieldCapacity)}, members...)...),
+			min: query.MinCapacity,
+			max: query.MaxCapacity,
+		})
+	}
+	if query.MinPanels != nil || query.MaxPanels != nil {
+		var minPanels, maxPanels *float64
+		if query.MinPanels != nil {
+			v := float64(*query.MinPanels)
+			minPanels = &v
+		}
+		if query.MaxPanels != nil {
+			v := float64(*query.MaxPanels)
+			maxPanels = &v
+		}
+		ranges = append(ranges, scoreFilter{
+			cmd: pipe.Do(ctx, append([]interface{}{"ZMSCORE", ks.SiteRangeIndexKey(models.SiteFieldPanels)}, members...)...),
+			min: minPanels,
+			max: maxPanels,
+		})
+	}
+
+	if pipe.Len() == 0 {
+		return keep, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for _, cmd := range sets {
+		for i, ok := range cmd.Val() {
+			if !ok {
+				keep[i] = false
+			}
+		}
+	}
+	for _, r := range ranges {
+		scores, err := r.cmd.Slice()
+		if err != nil {
+			return nil, err
+		}
+		for i := range keep {
+			var v float64
+			ok := i < len(scores)
+			if ok {
+				v, ok = parseScore(scores[i])
+			}
+			if !ok || (r.min != nil && v < *r.min) || (r.max != nil && v > *r.max) {
+				keep[i] = false
+			}
+		}
+	}
+	return keep, nil
+}
+
+func scoreBound(v *float64, open string) string {
+	if v == nil {
+		return open
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// Cursors hold the sort key of the last site on a page: "id", or
+// "capacity:id" when sorting by capacity.
+func formatSiteCursor(k siteSortKey, byCapacity bool) string {
+	if byCapacity {
+		return strconv.FormatFloat(k.value, 'g', -1, 64) + ":" + strconv.Itoa(k.id)
+	}
+	return strconv.Itoa(k.id)
+}
+
+func parseSiteCursor(cursor string, byCapacity bool) (siteSortKey, error) {
+	var k siteSortKey
+	idStr := cursor
+	if byCapacity {
+		valueStr, rest, ok := strings.Cut(cursor, ":")
+		if !ok {
+			return k, dao.ErrInvalidCursor
+		}
+		value, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			return k, dao.ErrInvalidCursor
+		}
+		k.value = value
+		idStr = rest
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return k, dao.ErrInvalidCursor
+	}
+	k.id = id
+	return k, nil
+}
@@ -0,0 +1,263 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/dao"
+	"redisolar-go/internal/models"
+)
+
+const defaultSearchLimit = 10
+
+// SiteSearchDaoRedis is a SiteDao whose site hashes are also indexed by
+// RediSearch, so free-text address and city search, capacity ranges and
+// geo radius filters run as a single FT.SEARCH. Without the search module
+// it falls back to filtering in Go.
+type SiteSearchDaoRedis struct {
+	*SiteGeoDaoRedis
+	sites *SiteDaoRedis
+
+	available atomic.Bool
+}
+
+func NewSiteSearchDao(base RedisDao) *SiteSearchDaoRedis {
+	return &SiteSearchDaoRedis{SiteGeoDaoRedis: NewSiteGeoDao(base), sites: NewSiteDao(base)}
+}
+
+// Insert writes a site, replacing it if it exists, through
+// SiteDaoRedis.InsertBatch so an existing site is removed from the indexes
+// of its old values.
+func (d *SiteSearchDaoRedis) Insert(ctx context.Context, site models.Site) error {
+	return d.sites.InsertBatch(ctx, []models.Site{site}, d.InsertWithClient)[0]
+}
+
+// InsertWithClient writes the site hash, which RediSearch indexes on its
+// own, along with the site ID set, site indexes and geo index.
+func (d *SiteSearchDaoRedis) InsertWithClient(ctx context.Context, site models.Site, client goredis.Cmdable) error {
+	if err := d.sites.InsertWithClient(ctx, site, client); err != nil {
+		return err
+	}
+	return d.SiteGeoDaoRedis.InsertWithClient(ctx, site, client)
+}
+
+func (d *SiteSearchDaoRedis) InsertMany(ctx context.Context, sites ...models.Site) error {
+	return firstError(d.sites.InsertBatch(ctx, sites, d.InsertWithClient))
+}
+
+// EnsureIndex creates the search index over site hashes if it does not
+// exist yet. It returns dao.ErrSearchUnavailable if the server does not
+// have the search module, in which case Search filters in Go.
+func (d *SiteSearchDaoRedis) EnsureIndex(ctx context.Context) error {
+	err := d.Client.FTCreate(ctx, d.KeySchema.SiteSearchIndex(),
+		&goredis.FTCreateOptions{
+			OnHash: true,
+			Prefix: []interface{}{d.KeySchema.SiteHashKeyPrefix()},
+		},
+		&goredis.FieldSchema{FieldName: models.SiteFieldAddress, FieldType: goredis.SearchFieldTypeText},
+		&goredis.FieldSchema{FieldName: models.SiteFieldCity, FieldType: goredis.SearchFieldTypeText},
+		&goredis.FieldSchema{FieldName: models.SiteFieldState, FieldType: goredis.SearchFieldTypeTag},
+		&goredis.FieldSchema{FieldName: models.SiteFieldPostalCode, FieldType: goredis.SearchFieldTypeTag},
+		&goredis.FieldSchema{FieldName: models.SiteFieldCapacity, FieldType: goredis.SearchFieldTypeNumeric, Sortable: true},
+		&goredis.FieldSchema{FieldName: models.SiteFieldPanels, FieldType: goredis.SearchFieldTypeNumeric, Sortable: true},
+		&goredis.FieldSchema{FieldName: models.SiteFieldLocation, FieldType: goredis.SearchFieldTypeGeo},
+	).Err()
+	if err != nil && !strings.Contains(err.Error(), "Index already exists") {
+		d.available.Store(false)
+		if isSearchUnavailable(err) {
+			return dao.ErrSearchUnavailable
+		}
+		return err
+	}
+	d.available.Store(true)
+	return nil
+}
+
+// Search returns the page of sites matching search and the total number of
+// matches.
+func (d *SiteSearchDaoRedis) Search(ctx context.Context, search models.SiteSearch) ([]models.Site, int64, error) {
+	if search.Limit <= 0 {
+		search.Limit = defaultSearchLimit
+	}
+	if d.available.Load() {
+		sites, total, err := d.ftSearch(ctx, search)
+		if err == nil || !isSearchUnavailable(err) {
+			return sites, total, err
+		}
+		// The module was unloaded or the index dropped.
+		d.available.Store(false)
+	}
+	return d.searchInGo(ctx, search)
+}
+
+func (d *SiteSearchDaoRedis) ftSearch(ctx context.Context, search models.SiteSearch) ([]models.Site, int64, error) {
+	// FT.SEARCH is sent raw: go-redis refuses its typed search commands on
+	// RESP3 connections, so both reply formats are parsed here.
+	reply, err := d.Client.Do(ctx, "FT.SEARCH", d.KeySchema.SiteSearchIndex(), siteSearchQuery(search),
+		"LIMIT", search.Offset, search.Limit).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	total, docs, err := parseSearchReply(reply)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sites := make([]models.Site, 0, len(docs))
+	for _, doc := range docs {
+		site, err := models.SiteFromFlatMap(doc)
+		if err != nil {
+			continue
+		}
+		sites = append(sites, site)
+	}
+	return sites, total, nil
+}
+
+// siteSearchQuery builds the RediSearch query for search. Text is reduced
+// to its words, so user input needs no escaping.
+func siteSearchQuery(search models.SiteSearch) string {
+	var parts []string
+	if terms := searchTerms(search.Text); len(terms) > 0 {
+		parts = append(parts, fmt.Sprintf("@%s|%s:(%s)",
+			models.SiteFieldAddress, models.SiteFieldCity, strings.Join(terms, " ")))
+	}
+	if search.MinCapacity != nil || search.MaxCapacity != nil {
+		parts = append(parts, fmt.Sprintf("@%s:[%s %s]", models.SiteFieldCapacity,
+			scoreBound(search.MinCapacity, "-inf"), scoreBound(search.MaxCapacity, "+inf")))
+	}
+	if near := search.Near; near != nil {
+		parts = append(parts, fmt.Sprintf("@%s:[%s %s %s %s]", models.SiteFieldLocation,
+			strconv.FormatFloat(near.Coordinate.Lng, 'f', -1, 64),
+			strconv.FormatFloat(near.Coordinate.Lat, 'f', -1, 64),
+			strconv.FormatFloat(near.Radius, 'f', -1, 64),
+			near.RadiusUnit))
+	}
+	if len(parts) == 0 {
+		return "*"
+	}
+	return strings.Join(parts, " ")
+}
+
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// parseSearchReply returns the total and the documents' fields from an
+// FT.SEARCH reply, in either its RESP2 or RESP3 form.
+func parseSearchReply(reply interface{}) (int64, []map[string]string, error) {
+	switch v := reply.(type) {
+	case []interface{}:
+		// RESP2: total, then each key followed by its field/value list.
+		if len(v) == 0 {
+			return 0, nil, fmt.Errorf("empty FT.SEARCH reply")
+		}
+		total, _ := v[0].(int64)
+		var docs []map[string]string
+		for i := 1; i+1 < len(v); i += 2 {
+			fields, _ := v[i+1].([]interface{})
+			doc := make(map[string]string, len(fields)/2)
+			for j := 0; j+1 < len(fields); j += 2 {
+				doc[fmt.Sprint(fields[j])] = fmt.Sprint(fields[j+1])
+			}
+			docs = append(docs, doc)
+		}
+		return total, docs, nil
+	case map[interface{}]interface{}:
+		// RESP3: a map with total_results and results, each result holding
+		// its fields in extra_attributes.
+		total, _ := v["total_results"].(int64)
+		results, _ := v["results"].([]interface{})
+		docs := make([]map[string]string, 0, len(results))
+		for _, r := range results {
+			result, _ := r.(map[interface{}]interface{})
+			attrs, _ := result["extra_attributes"].(map[interface{}]interface{})
+			doc := make(map[string]string, len(attrs))
+			for k, val := range attrs {
+				doc[fmt.Sprint(k)] = fmt.Sprint(val)
+			}
+			docs = append(docs, doc)
+		}
+		return total, docs, nil
+	default:
+		return 0, nil, fmt.Errorf("unexpected FT.SEARCH reply %T", reply)
+	}
+}
+
+func isSearchUnavailable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unknown command") ||
+		strings.Contains(msg, "unknown index") ||
+		strings.Contains(msg, "no such index")
+}
+
+// searchInGo answers search without RediSearch: capacity through the
+// capacity index, the radius through the geo index, and text by matching
+// every term against the words of each site's address and city.
+func (d *SiteSearchDaoRedis) searchInGo(ctx context.Context, search models.SiteSearch) ([]models.Site, int64, error) {
+	sites, _, err := listSites(ctx, d.RedisDao, models.SiteQuery{
+		MinCapacity: search.MinCapacity,
+		MaxCapacity: search.MaxCapacity,
+		Sort:        models.SiteSortID,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var near map[int]bool
+	if search.Near != nil {
+		locations, err := geoSearch(ctx, d.RedisDao, *search.Near)
+		if err != nil {
+			return nil, 0, err
+		}
+		near = make(map[int]bool, len(locations))
+		for _, loc := range locations {
+			if id, err := strconv.Atoi(loc.Name); err == nil {
+				near[id] = true
+			}
+		}
+	}
+
+	terms := searchTerms(search.Text)
+	var matched []models.Site
+	for _, site := range sites {
+		if near != nil && !near[site.ID] {
+			continue
+		}
+		if !matchesTerms(site, terms) {
+			continue
+		}
+		matched = append(matched, site)
+	}
+
+	total := int64(len(matched))
+	if search.Offset >= len(matched) {
+		return []models.Site{}, total, nil
+	}
+	end := search.Offset + search.Limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[search.Offset:end], total, nil
+}
+
+func matchesTerms(site models.Site, terms []string) bool {
+	words := make(map[string]bool)
+	for _, w := range searchTerms(site.Address + " " + site.City) {
+		words[w] = true
+	}
+	for _, term := range terms {
+		if !words[term] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package redis
+
+import (
+	"testing"
+
+	"redisolar-go/internal/models"
+)
+
+func TestSiteSearchQuery(t *testing.T) {
+	min, max := 1.5, 10.0
+	tests := []struct {
+		name   string
+		search models.SiteSearch
+		want   string
+	}{
+		{"empty", models.SiteSearch{}, "*"},
+		{"text", models.SiteSearch{Text: "123 Main St."}, "@address|city:(123 main st)"},
+		{"min capacity", models.SiteSearch{MinCapacity: &min}, "@capacity:[1.5 +inf]"},
+		{"capacity range", models.SiteSearch{MinCapacity: &min, MaxCapacity: &max}, "@capacity:[1.5 10]"},
+		{"near", models.SiteSearch{Near: &models.GeoQuery{
+			Coordinate: models.Coordinate{Lat: 37.7, Lng: -122.2},
+			Radius:     5,
+			RadiusUnit: models.GeoUnitKM,
+		}}, "@location:[-122.2 37.7 5 km]"},
+		{"combined", models.SiteSearch{Text: "oakland", MaxCapacity: &max},
+			"@address|city:(oakland) @capacity:[-inf 10]"},
+	}
+
+	for _, tt := range tests {
+		if got := siteSearchQuery(tt.search); got != tt.want {
+			t.Errorf("%s: siteSearchQuery() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseSearchReply(t *testing.T) {
+	resp2 := []interface{}{
+		int64(2),
+		"sites:info:1", []interface{}{"id", "1", "city", "Oakland"},
+		"sites:info:2", []interface{}{"id", "2", "city", "Berkeley"},
+	}
+	resp3 := map[interface{}]interface{}{
+		"total_results": int64(2),
+		"results": []interface{}{
+			map[interface{}]interface{}{
+				"id":               "sites:info:1",
+				"extra_attributes": map[interface{}]interface{}{"id": "1", "city": "Oakland"},
+			},
+			map[interface{}]interface{}{
+				"id":               "sites:info:2",
+				"extra_attributes": map[interface{}]interface{}{"id": "2", "city": "Berkeley"},
+			},
+		},
+	}
+
+	for name, reply := range map[string]interface{}{"RESP2": resp2, "RESP3": resp3} {
+		total, docs, err := parseSearchReply(reply)
+		if err != nil {
+			t.Fatalf("%s: parseSearchReply() error = %v", name, err)
+		}
+		if total != 2 || len(docs) != 2 {
+			t.Fatalf("%s: parseSearchReply() = %d, %d docs, want 2, 2 docs", name, total, len(docs))
+		}
+		if docs[0]["id"] != "1" || docs[1]["city"] != "Berkeley" {
+			t.Errorf("%s: parseSearchReply() docs = %v", name, docs)
+		}
+	}
+}
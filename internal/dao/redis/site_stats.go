@@ -34,18 +34,31 @@ func (d *SiteStatsDaoRedis) FindByID(ctx context.Context, siteID int, day time.T
 		return models.SiteStats{}, nil
 	}
 
-	count, _ := strconv.ParseInt(fields[models.SiteStatsCount], 10, 64)
-	maxWH, _ := strconv.ParseFloat(fields[models.SiteStatsMaxWH], 64)
-	minWH, _ := strconv.ParseFloat(fields[models.SiteStatsMinWH], 64)
-	maxCap, _ := strconv.ParseFloat(fields[models.SiteStatsMaxCapacity], 64)
+	return siteStatsFromHash(fields), nil
+}
 
-	return models.SiteStats{
-		LastReportingTime: fields[models.SiteStatsLastReportingTime],
-		MeterReadingCount: count,
-		MaxWHGenerated:    maxWH,
-		MinWHGenerated:    minWH,
-		MaxCapacity:       maxCap,
-	}, nil
+// FindByDays returns the stats for a site on each of the given days, in the
+// same order, fetching every day's hash in a single pipeline. Days without
+// any readings yield a zero SiteStats.
+func (d *SiteStatsDaoRedis) FindByDays(ctx context.Context, siteID int, days []time.Time) ([]models.SiteStats, error) {
+	pipe := d.Client.Pipeline()
+	cmds := make([]*goredis.MapStringStringCmd, len(days))
+	for i, day := range days {
+		cmds[i] = pipe.HGetAll(ctx, d.KeySchema.SiteStatsKey(siteID, day))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	stats := make([]models.SiteStats, len(days))
+	for i, cmd := range cmds {
+		fields, _ := cmd.Result()
+		if len(fields) == 0 {
+			continue
+		}
+		stats[i] = siteStatsFromHash(fields)
+	}
+	return stats, nil
 }
 
 func (d *SiteStatsDaoRedis) Update(ctx context.Context, reading models.MeterReading) error {
@@ -59,6 +72,7 @@ func (d *SiteStatsDaoRedis) UpdateWithPipeline(ctx context.Context, reading mode
 	execute := false
 	if pipe == nil {
 		pipe = d.Client.Pipeline()
+		scripts.Preload(ctx, pipe)
 		execute = true
 	}
 
@@ -77,3 +91,47 @@ func (d *SiteStatsDaoRedis) UpdateWithPipeline(ctx context.Context, reading mode
 	}
 	return nil
 }
+
+// EnqueueWithPipeline queues a reading on pipe for a deferred stats update
+// by a worker. The queue is not trimmed; the worker deletes entries once
+// they are applied.
+func (d *SiteStatsDaoRedis) EnqueueWithPipeline(ctx context.Context, reading models.MeterReading, pipe goredis.Pipeliner) {
+	pipe.XAdd(ctx, &goredis.XAddArgs{
+		Stream: d.KeySchema.StatsQueueKey(),
+		Values: models.MeterReadingToStreamMap(reading),
+	})
+}
+
+// ApplyOnce updates the stats for the reading queued as entryID, unless
+// that entry was already applied. The entry's marker is set in the same
+// transaction as the update, so a redelivered entry is not counted twice.
+func (d *SiteStatsDaoRedis) ApplyOnce(ctx context.Context, entryID string, reading models.MeterReading) error {
+	marker := d.KeySchema.StatsAppliedKey(entryID)
+	return d.Client.Watch(ctx, func(tx *goredis.Tx) error {
+		applied, err := tx.Exists(ctx, marker).Result()
+		if err != nil || applied > 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			scripts.Preload(ctx, pipe)
+			pipe.Set(ctx, marker, 1, DedupeTTL)
+			return d.UpdateWithPipeline(ctx, reading, pipe)
+		})
+		return err
+	}, marker)
+}
+
+func siteStatsFromHash(fields map[string]string) models.SiteStats {
+	count, _ := strconv.ParseInt(fields[models.SiteStatsCount], 10, 64)
+	maxWH, _ := strconv.ParseFloat(fields[models.SiteStatsMaxWH], 64)
+	minWH, _ := strconv.ParseFloat(fields[models.SiteStatsMinWH], 64)
+	maxCap, _ := strconv.ParseFloat(fields[models.SiteStatsMaxCapacity], 64)
+
+	return models.SiteStats{
+		LastReportingTime: fields[models.SiteStatsLastReportingTime],
+		MeterReadingCount: count,
+		MaxWHGenerated:    maxWH,
+		MinWHGenerated:    minWH,
+		MaxCapacity:       maxCap,
+	}
+}
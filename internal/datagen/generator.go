@@ -10,11 +10,18 @@ import (
 	redisdao "redisolar-go/internal/dao/redis"
 	"redisolar-go/internal/keyschema"
 	"redisolar-go/internal/models"
+	"redisolar-go/internal/scripts"
 )
 
-const maxTemperatureC = 30.0
+const (
+	maxTemperatureC = 30.0
+	flushEvery      = 500 // readings per pipeline round trip
+)
 
 type SampleDataGenerator struct {
+	// MetricBackend is where the generated metrics are written.
+	MetricBackend redisdao.MetricBackend
+
 	client     *goredis.Client
 	sites      []models.Site
 	minuteDays int
@@ -64,7 +71,9 @@ func getNextValue(maximum, current float64) float64 {
 }
 
 func (g *SampleDataGenerator) Generate(ctx context.Context, pipe goredis.Pipeliner) int {
-	meterReadingDao := redisdao.NewMeterReadingDao(redisdao.NewRedisDao(g.client, g.keySchema))
+	base := redisdao.NewRedisDao(g.client, g.keySchema)
+	base.MetricBackend = g.MetricBackend
+	meterReadingDao := redisdao.NewMeterReadingDao(base)
 
 	for sIdx, site := range g.sites {
 		maxCap := getMaxMinuteWHGenerated(site.Capacity)
@@ -91,12 +100,18 @@ func (g *SampleDataGenerator) Generate(ctx context.Context, pipe goredis.Pipelin
 	}
 
 	count := 0
+	scripts.Preload(ctx, pipe)
 	for i := 0; i < g.minuteDays; i++ {
 		for j := 0; j < len(g.sites); j++ {
 			reading := g.readings[j][i]
-			meterReadingDao.Add(ctx, reading)
+			meterReadingDao.AddWithPipeline(ctx, reading, pipe)
 			count++
+			if count%flushEvery == 0 {
+				pipe.Exec(ctx)
+				scripts.Preload(ctx, pipe)
+			}
 		}
 	}
+	pipe.Exec(ctx)
 	return count
 }
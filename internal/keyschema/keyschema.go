@@ -26,6 +26,18 @@ func (ks *KeySchema) SiteHashKey(siteID int) string {
 	return ks.prefixed(fmt.Sprintf("sites:info:%d", siteID))
 }
 
+// SiteHashKeyPrefix returns the prefix shared by all site hash keys:
+// sites:info:
+func (ks *KeySchema) SiteHashKeyPrefix() string {
+	return ks.prefixed("sites:info:")
+}
+
+// SiteSearchIndex returns the name of the RediSearch index over site
+// hashes: sites:search
+func (ks *KeySchema) SiteSearchIndex() string {
+	return ks.prefixed("sites:search")
+}
+
 // SiteIDsKey returns the key for the set of all site IDs: sites:ids
 func (ks *KeySchema) SiteIDsKey() string {
 	return ks.prefixed("sites:ids")
@@ -36,6 +48,18 @@ func (ks *KeySchema) SiteGeoKey() string {
 	return ks.prefixed("sites:geo")
 }
 
+// SiteIndexKey returns the key for the set of sites with the given value
+// of a site field: sites:idx:[field]:[value]
+func (ks *KeySchema) SiteIndexKey(field string, value string) string {
+	return ks.prefixed(fmt.Sprintf("sites:idx:%s:%s", field, value))
+}
+
+// SiteRangeIndexKey returns the key for the sorted set of sites scored by a
+// numeric site field: sites:idx:[field]
+func (ks *KeySchema) SiteRangeIndexKey(field string) string {
+	return ks.prefixed(fmt.Sprintf("sites:idx:%s", field))
+}
+
 // SiteStatsKey returns the key for site stats: sites:stats:[day]:[site_id]
 func (ks *KeySchema) SiteStatsKey(siteID int, day time.Time) string {
 	return ks.prefixed(fmt.Sprintf("sites:stats:%s:%d", day.Format("2006-01-02"), siteID))
@@ -46,6 +70,43 @@ func (ks *KeySchema) CapacityRankingKey() string {
 	return ks.prefixed("sites:capacity:ranking")
 }
 
+// CapacityHourKey returns the key for the sum of each site's capacity
+// readings in the UTC hour containing t: sites:capacity:hour:[yyyy-mm-ddThh]
+func (ks *KeySchema) CapacityHourKey(t time.Time) string {
+	return ks.prefixed(fmt.Sprintf("sites:capacity:hour:%s", t.UTC().Format("2006-01-02T15")))
+}
+
+// CapacityHourCountKey returns the key for the number of each site's
+// capacity readings in the UTC hour containing t:
+// sites:capacity:hour:[yyyy-mm-ddThh]:count
+func (ks *KeySchema) CapacityHourCountKey(t time.Time) string {
+	return ks.CapacityHourKey(t) + ":count"
+}
+
+// CapacityDayKey returns the key for the sum of each site's capacity
+// readings in the UTC day containing t: sites:capacity:day:[yyyy-mm-dd]
+func (ks *KeySchema) CapacityDayKey(t time.Time) string {
+	return ks.prefixed(fmt.Sprintf("sites:capacity:day:%s", t.UTC().Format("2006-01-02")))
+}
+
+// CapacityDayCountKey returns the key for the number of each site's
+// capacity readings in the UTC day containing t:
+// sites:capacity:day:[yyyy-mm-dd]:count
+func (ks *KeySchema) CapacityDayCountKey(t time.Time) string {
+	return ks.CapacityDayKey(t) + ":count"
+}
+
+// CapacityAverageKey returns the key for sites scored by their moving
+// average capacity: sites:capacity:average
+func (ks *KeySchema) CapacityAverageKey() string {
+	return ks.prefixed("sites:capacity:average")
+}
+
+// TempKey returns the key for short-lived intermediate results: tmp:[name]
+func (ks *KeySchema) TempKey(name string) string {
+	return ks.prefixed(fmt.Sprintf("tmp:%s", name))
+}
+
 // DayMetricKey returns the key for a day's metrics: metric:[unit]:[day]:[site_id]
 func (ks *KeySchema) DayMetricKey(siteID int, unit models.MetricUnit, t time.Time) string {
 	return ks.prefixed(fmt.Sprintf("metric:%s:%s:%d", string(unit), t.Format("2006-01-02"), siteID))
@@ -61,6 +122,42 @@ func (ks *KeySchema) FeedKey(siteID int) string {
 	return ks.prefixed(fmt.Sprintf("sites:feed:%d", siteID))
 }
 
+// FeedDeadLetterKey returns the key for global feed entries that could not
+// be processed: sites:feed:dead-letter
+func (ks *KeySchema) FeedDeadLetterKey() string {
+	return ks.prefixed("sites:feed:dead-letter")
+}
+
+// StatsQueueKey returns the key for readings queued for a deferred site
+// stats update: sites:stats-queue
+func (ks *KeySchema) StatsQueueKey() string {
+	return ks.prefixed("sites:stats-queue")
+}
+
+// StatsDeadLetterKey returns the key for queued stats updates that could not
+// be applied: sites:stats-queue:dead-letter
+func (ks *KeySchema) StatsDeadLetterKey() string {
+	return ks.prefixed("sites:stats-queue:dead-letter")
+}
+
+// StatsAppliedKey returns the key marking a stats queue entry as applied:
+// sites:stats-queue:applied:[entry_id]
+func (ks *KeySchema) StatsAppliedKey(entryID string) string {
+	return ks.prefixed(fmt.Sprintf("sites:stats-queue:applied:%s", entryID))
+}
+
+// IngestStreamKey returns the key for readings queued for async ingest:
+// sites:ingest
+func (ks *KeySchema) IngestStreamKey() string {
+	return ks.prefixed("sites:ingest")
+}
+
+// IngestDeadLetterKey returns the key for queued readings that could not be
+// ingested: sites:ingest:dead-letter
+func (ks *KeySchema) IngestDeadLetterKey() string {
+	return ks.prefixed("sites:ingest:dead-letter")
+}
+
 // FixedRateLimiterKey returns the key for a fixed-window rate limiter.
 func (ks *KeySchema) FixedRateLimiterKey(name string, minuteBlock int, maxHits int) string {
 	return ks.prefixed(fmt.Sprintf("limiter:%s:%d:%d", name, minuteBlock, maxHits))
@@ -75,3 +172,27 @@ func (ks *KeySchema) SlidingWindowRateLimiterKey(name string, windowSizeMs int,
 func (ks *KeySchema) TimeseriesKey(siteID int, unit models.MetricUnit) string {
 	return ks.prefixed(fmt.Sprintf("sites:ts:%d:%s", siteID, string(unit)))
 }
+
+// TimeseriesHourKey returns the key for a timeseries' hourly compaction:
+// sites:ts:[site_id]:[unit]:hour
+func (ks *KeySchema) TimeseriesHourKey(siteID int, unit models.MetricUnit) string {
+	return ks.prefixed(fmt.Sprintf("sites:ts:%d:%s:hour", siteID, string(unit)))
+}
+
+// TimeseriesDayKey returns the key for a timeseries' daily compaction:
+// sites:ts:[site_id]:[unit]:day
+func (ks *KeySchema) TimeseriesDayKey(siteID int, unit models.MetricUnit) string {
+	return ks.prefixed(fmt.Sprintf("sites:ts:%d:%s:day", siteID, string(unit)))
+}
+
+// ReadingDedupeKey returns the key marking a reading as ingested:
+// sites:dedupe:[site_id]:[timestamp_ms]
+func (ks *KeySchema) ReadingDedupeKey(siteID int, t time.Time) string {
+	return ks.prefixed(fmt.Sprintf("sites:dedupe:%d:%d", siteID, t.UnixMilli()))
+}
+
+// IdempotencyKey returns the key storing the response for an
+// Idempotency-Key request header: idempotency:[key]
+func (ks *KeySchema) IdempotencyKey(key string) string {
+	return ks.prefixed(fmt.Sprintf("idempotency:%s", key))
+}
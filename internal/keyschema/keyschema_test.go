@@ -1,6 +1,7 @@
 package keyschema
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +17,27 @@ func TestSiteHashKey(t *testing.T) {
 	}
 }
 
+func TestSiteHashKeyPrefix(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.SiteHashKeyPrefix()
+	want := "ru102py-test:sites:info:"
+	if got != want {
+		t.Errorf("SiteHashKeyPrefix() = %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(ks.SiteHashKey(1), got) {
+		t.Errorf("SiteHashKey(1) = %q, does not start with %q", ks.SiteHashKey(1), got)
+	}
+}
+
+func TestSiteSearchIndex(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.SiteSearchIndex()
+	want := "ru102py-test:sites:search"
+	if got != want {
+		t.Errorf("SiteSearchIndex() = %q, want %q", got, want)
+	}
+}
+
 func TestSiteIDsKey(t *testing.T) {
 	ks := New("ru102py-test")
 	got := ks.SiteIDsKey()
@@ -34,6 +56,24 @@ func TestSiteGeoKey(t *testing.T) {
 	}
 }
 
+func TestSiteIndexKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.SiteIndexKey("state", "ca")
+	want := "ru102py-test:sites:idx:state:ca"
+	if got != want {
+		t.Errorf("SiteIndexKey(\"state\", \"ca\") = %q, want %q", got, want)
+	}
+}
+
+func TestSiteRangeIndexKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.SiteRangeIndexKey("capacity")
+	want := "ru102py-test:sites:idx:capacity"
+	if got != want {
+		t.Errorf("SiteRangeIndexKey(\"capacity\") = %q, want %q", got, want)
+	}
+}
+
 func TestSiteStatsKey(t *testing.T) {
 	ks := New("ru102py-test")
 	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -81,6 +121,42 @@ func TestFeedKey(t *testing.T) {
 	}
 }
 
+func TestFeedDeadLetterKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.FeedDeadLetterKey()
+	want := "ru102py-test:sites:feed:dead-letter"
+	if got != want {
+		t.Errorf("FeedDeadLetterKey() = %q, want %q", got, want)
+	}
+}
+
+func TestStatsQueueKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.StatsQueueKey()
+	want := "ru102py-test:sites:stats-queue"
+	if got != want {
+		t.Errorf("StatsQueueKey() = %q, want %q", got, want)
+	}
+}
+
+func TestStatsAppliedKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.StatsAppliedKey("1-0")
+	want := "ru102py-test:sites:stats-queue:applied:1-0"
+	if got != want {
+		t.Errorf("StatsAppliedKey(\"1-0\") = %q, want %q", got, want)
+	}
+}
+
+func TestIngestStreamKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.IngestStreamKey()
+	want := "ru102py-test:sites:ingest"
+	if got != want {
+		t.Errorf("IngestStreamKey() = %q, want %q", got, want)
+	}
+}
+
 func TestTimeseriesKey(t *testing.T) {
 	ks := New("ru102py-test")
 	got := ks.TimeseriesKey(1, models.WHGenerated)
@@ -89,3 +165,88 @@ func TestTimeseriesKey(t *testing.T) {
 		t.Errorf("TimeseriesKey(1, WHGenerated) = %q, want %q", got, want)
 	}
 }
+
+func TestTimeseriesHourKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.TimeseriesHourKey(1, models.WHGenerated)
+	want := "ru102py-test:sites:ts:1:whG:hour"
+	if got != want {
+		t.Errorf("TimeseriesHourKey(1, WHGenerated) = %q, want %q", got, want)
+	}
+}
+
+func TestTimeseriesDayKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.TimeseriesDayKey(1, models.TempCelsius)
+	want := "ru102py-test:sites:ts:1:tempC:day"
+	if got != want {
+		t.Errorf("TimeseriesDayKey(1, TempCelsius) = %q, want %q", got, want)
+	}
+}
+
+func TestReadingDedupeKey(t *testing.T) {
+	ks := New("ru102py-test")
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	got := ks.ReadingDedupeKey(1, ts)
+	want := "ru102py-test:sites:dedupe:1:1577836800000"
+	if got != want {
+		t.Errorf("ReadingDedupeKey(1, ts) = %q, want %q", got, want)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.IdempotencyKey("abc")
+	want := "ru102py-test:idempotency:abc"
+	if got != want {
+		t.Errorf("IdempotencyKey(\"abc\") = %q, want %q", got, want)
+	}
+}
+
+func TestCapacityAverageKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.CapacityAverageKey()
+	want := "ru102py-test:sites:capacity:average"
+	if got != want {
+		t.Errorf("CapacityAverageKey() = %q, want %q", got, want)
+	}
+}
+
+func TestTempKey(t *testing.T) {
+	ks := New("ru102py-test")
+	got := ks.TempKey("geo:1")
+	want := "ru102py-test:tmp:geo:1"
+	if got != want {
+		t.Errorf("TempKey(\"geo:1\") = %q, want %q", got, want)
+	}
+}
+
+func TestCapacityHourKey(t *testing.T) {
+	ks := New("ru102py-test")
+	ts := time.Date(2020, 1, 1, 13, 45, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	got := ks.CapacityHourKey(ts)
+	want := "ru102py-test:sites:capacity:hour:2020-01-01T11"
+	if got != want {
+		t.Errorf("CapacityHourKey(ts) = %q, want %q", got, want)
+	}
+}
+
+func TestCapacityDayKey(t *testing.T) {
+	ks := New("ru102py-test")
+	ts := time.Date(2020, 1, 1, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	got := ks.CapacityDayKey(ts)
+	want := "ru102py-test:sites:capacity:day:2019-12-31"
+	if got != want {
+		t.Errorf("CapacityDayKey(ts) = %q, want %q", got, want)
+	}
+}
+
+func TestCapacityHourCountKey(t *testing.T) {
+	ks := New("ru102py-test")
+	ts := time.Date(2020, 1, 1, 13, 45, 0, 0, time.UTC)
+	got := ks.CapacityHourCountKey(ts)
+	want := "ru102py-test:sites:capacity:hour:2020-01-01T13:count"
+	if got != want {
+		t.Errorf("CapacityHourCountKey(ts) = %q, want %q", got, want)
+	}
+}
@@ -19,6 +19,8 @@ func SiteToFlatMap(s Site) map[string]interface{} {
 	if s.Coordinate != nil {
 		m[SiteFieldLat] = s.Coordinate.Lat
 		m[SiteFieldLng] = s.Coordinate.Lng
+		m[SiteFieldLocation] = strconv.FormatFloat(s.Coordinate.Lng, 'f', -1, 64) + "," +
+			strconv.FormatFloat(s.Coordinate.Lat, 'f', -1, 64)
 	}
 	return m
 }
@@ -135,3 +137,38 @@ func toInt(v interface{}) (int, error) {
 		return 0, fmt.Errorf("cannot convert %T to int", v)
 	}
 }
+
+// NetCapacityMeasurements pairs generated and used measurements by
+// timestamp and returns generated minus used for each pair.
+func NetCapacityMeasurements(generated, used []Measurement) []Measurement {
+	usedAt := make(map[float64]float64, len(used))
+	for _, m := range used {
+		usedAt[m.Timestamp] = m.Value
+	}
+	net := make([]Measurement, 0, len(generated))
+	for _, m := range generated {
+		u, ok := usedAt[m.Timestamp]
+		if !ok {
+			continue
+		}
+		net = append(net, Measurement{
+			SiteID:     m.SiteID,
+			MetricUnit: NetCapacity,
+			Timestamp:  m.Timestamp,
+			Value:      m.Value - u,
+		})
+	}
+	return net
+}
+
+// FahrenheitMeasurements converts Celsius temperature measurements to
+// Fahrenheit.
+func FahrenheitMeasurements(celsius []Measurement) []Measurement {
+	converted := make([]Measurement, len(celsius))
+	for i, m := range celsius {
+		m.MetricUnit = TempFahrenheit
+		m.Value = m.Value*9/5 + 32
+		converted[i] = m
+	}
+	return converted
+}
@@ -11,6 +11,69 @@ const (
 	TempCelsius MetricUnit = "tempC"
 )
 
+// Derived metric units, computed from the stored ones on output.
+const (
+	NetCapacity    MetricUnit = "net"   // watt-hours generated minus used
+	TempFahrenheit MetricUnit = "tempF" // TempCelsius converted
+)
+
+// MetricAggregation represents how measurements are combined into a
+// downsampled bucket.
+type MetricAggregation string
+
+const (
+	MetricAggAvg MetricAggregation = "avg"
+	MetricAggMin MetricAggregation = "min"
+	MetricAggMax MetricAggregation = "max"
+	MetricAggSum MetricAggregation = "sum"
+)
+
+// MetricRange represents a query for a site's measurements between From
+// and To, both inclusive. With a Bucket, measurements are combined per
+// bucket with Aggregation, and each bucket is stamped with its start.
+type MetricRange struct {
+	From        time.Time
+	To          time.Time
+	Bucket      time.Duration
+	Aggregation MetricAggregation
+	Limit       int
+}
+
+// FleetGroup represents the series label a fleet query groups sites by.
+type FleetGroup string
+
+const (
+	FleetGroupAll   FleetGroup = ""
+	FleetGroupState FleetGroup = "state"
+	FleetGroupCity  FleetGroup = "city"
+)
+
+// FleetQuery represents a query for a unit's measurements across every
+// site, or those in State and City, reduced to one series per group.
+type FleetQuery struct {
+	Unit    MetricUnit
+	State   string
+	City    string
+	GroupBy FleetGroup
+	Reduce  MetricAggregation
+	Range   MetricRange
+}
+
+// FleetSeries represents the reduced measurements of one group of sites.
+// Group is the label value the sites share, or empty for the whole fleet.
+type FleetSeries struct {
+	Group        string
+	Measurements []Measurement
+}
+
+// FleetValue represents the reduced latest measurements of one group of
+// sites, and how many sites reported one.
+type FleetValue struct {
+	Group string
+	Value float64
+	Sites int
+}
+
 // GeoUnit represents geographic units available for geo queries.
 type GeoUnit string
 
@@ -51,12 +114,122 @@ type CapacityReport struct {
 	LowestCapacity  []SiteCapacityTuple `json:"lowest_capacity"`
 }
 
-// GeoQuery represents parameters for a geo query.
+// SiteCapacityRank represents where a site's current capacity ranks among
+// all reporting sites. Rank 1 is the highest capacity. Percentile is the
+// share of reporting sites ranked at or below the site. Above and Below
+// hold the neighbouring sites in rank order.
+type SiteCapacityRank struct {
+	SiteID     int
+	Rank       int64
+	Capacity   float64
+	Percentile float64
+	Total      int64
+	Above      []SiteCapacityTuple
+	Below      []SiteCapacityTuple
+}
+
+// CapacityBucket represents the period a historical capacity ranking covers.
+type CapacityBucket string
+
+const (
+	CapacityBucketHour CapacityBucket = "hour"
+	CapacityBucketDay  CapacityBucket = "day"
+)
+
+// GeoSort represents the order of geo query results by distance.
+type GeoSort string
+
+const (
+	GeoSortNone GeoSort = ""
+	GeoSortAsc  GeoSort = "ASC"
+	GeoSortDesc GeoSort = "DESC"
+)
+
+// CapacityMetric represents which capacity a geo query filters on.
+type CapacityMetric string
+
+const (
+	CapacityCurrent CapacityMetric = "current" // from the latest reading
+	CapacityAverage CapacityMetric = "average" // moving average of readings
+)
+
+// GeoQuery represents parameters for a geo query: sites within Radius of
+// Coordinate or, when BoxWidth and BoxHeight are set, within that box
+// centred on Coordinate. Distances are in RadiusUnit.
+//
+// MinCapacity and MaxCapacity bound the sites' CapacityMetric; nil bounds
+// are open. OnlyExcessCapacity keeps sites above the DAO's excess capacity
+// threshold unless MinCapacity is set.
 type GeoQuery struct {
 	Coordinate         Coordinate
 	Radius             float64
 	RadiusUnit         GeoUnit
+	BoxWidth           float64
+	BoxHeight          float64
+	Count              int // only the Count nearest sites; 0 for all
+	Sort               GeoSort
 	OnlyExcessCapacity bool
+	MinCapacity        *float64
+	MaxCapacity        *float64
+	CapacityMetric     CapacityMetric
+}
+
+// IsBox reports whether the query searches a box rather than a radius.
+func (q GeoQuery) IsBox() bool {
+	return q.BoxWidth > 0 && q.BoxHeight > 0
+}
+
+// GeoSite represents a site found by a geo query, with its distance from
+// the query point in the query's unit.
+type GeoSite struct {
+	Site
+	Distance float64
+}
+
+// SiteSort is a field site listings can be ordered by.
+type SiteSort string
+
+const (
+	SiteSortID       SiteSort = "id"
+	SiteSortCapacity SiteSort = "capacity"
+)
+
+// SiteQuery represents filters, ordering and pagination for a site listing.
+// Zero-valued filters are not applied; nil bounds are open.
+type SiteQuery struct {
+	State       string
+	City        string
+	PostalCode  string
+	MinCapacity *float64
+	MaxCapacity *float64
+	MinPanels   *int
+	MaxPanels   *int
+	Sort        SiteSort
+	Descending  bool
+	Limit       int
+	Cursor      string // returned as the next cursor by the previous page
+}
+
+// SiteSearch represents a full-text, capacity and geo search over sites.
+// Zero-valued criteria are not applied; nil bounds are open.
+type SiteSearch struct {
+	Text        string
+	MinCapacity *float64
+	MaxCapacity *float64
+	Near        *GeoQuery
+	Offset      int
+	Limit       int
+}
+
+// SiteCluster represents the sites in one geohash cell, aggregated for
+// drawing on a map.
+type SiteCluster struct {
+	GeoHash                string
+	Center                 Coordinate // mean position of the sites
+	Count                  int
+	TotalCapacity          float64
+	Reporting              int // sites with a current capacity
+	AverageCurrentCapacity float64
 }
 
 // Measurement represents a measurement taken for a site.
@@ -88,6 +261,12 @@ func (mr MeterReading) TimestampTime() time.Time {
 	return time.Unix(sec, nsec)
 }
 
+// FeedEntry is a meter reading together with the ID of its stream entry.
+type FeedEntry struct {
+	ID      string       `json:"id"`
+	Reading MeterReading `json:"reading"`
+}
+
 // Plot represents a plot of measurements.
 type Plot struct {
 	Measurements []Measurement `json:"measurements"`
@@ -123,4 +302,5 @@ const (
 	SiteFieldPostalCode = "postal_code"
 	SiteFieldLat        = "lat"
 	SiteFieldLng        = "lng"
+	SiteFieldLocation   = "location" // "lng,lat", for RediSearch GEO fields
 )
@@ -0,0 +1,253 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/models"
+)
+
+const DeadLetterMaxLength = 10000
+
+// Handler processes one meter reading read from a stream. Returning an
+// error leaves the entry pending, so it is retried once it is reclaimed.
+type Handler func(ctx context.Context, entry models.FeedEntry) error
+
+// Config describes a consumer group and how its workers behave.
+type Config struct {
+	Stream     string        // stream to consume
+	Group      string        // consumer group name
+	StartID    string        // where a newly created group starts; defaults to "$"
+	Consumer   string        // consumer name prefix; workers append "-N"
+	DeadLetter string        // stream receiving entries that cannot be processed
+	Workers    int           // number of concurrent consumers
+	BatchSize  int64         // entries per XREADGROUP/XAUTOCLAIM call
+	Block      time.Duration // how long XREADGROUP waits for new entries
+	ClaimIdle  time.Duration // idle time after which a pending entry is reclaimed
+	ClaimEvery time.Duration // how often pending entries are checked
+
+	// MaxDeliveries is how many times an entry is handed to the handler
+	// before it is moved to the dead-letter stream.
+	MaxDeliveries int64
+
+	// DeleteOnAck removes entries from the stream once they are processed,
+	// for queues that are not trimmed by length.
+	DeleteOnAck bool
+}
+
+func (c Config) withDefaults() Config {
+	if c.StartID == "" {
+		c.StartID = "$"
+	}
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.Block <= 0 {
+		c.Block = 5 * time.Second
+	}
+	if c.ClaimIdle <= 0 {
+		c.ClaimIdle = time.Minute
+	}
+	if c.ClaimEvery <= 0 {
+		c.ClaimEvery = c.ClaimIdle / 2
+	}
+	if c.MaxDeliveries <= 0 {
+		c.MaxDeliveries = 5
+	}
+	return c
+}
+
+// Processor runs a Redis Streams consumer group: several workers reading
+// with XREADGROUP, a reclaimer taking over entries left pending by dead
+// workers with XAUTOCLAIM, and a dead-letter stream for entries that are
+// not valid meter readings or keep failing.
+type Processor struct {
+	client *goredis.Client
+	cfg    Config
+	handle Handler
+}
+
+func New(client *goredis.Client, cfg Config, handle Handler) *Processor {
+	return &Processor{client: client, cfg: cfg.withDefaults(), handle: handle}
+}
+
+// Run creates the consumer group if needed and processes entries until ctx
+// is cancelled.
+func (p *Processor) Run(ctx context.Context) error {
+	err := p.client.XGroupCreateMkStream(ctx, p.cfg.Stream, p.cfg.Group, p.cfg.StartID).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("creating group %s on %s: %w", p.cfg.Group, p.cfg.Stream, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= p.cfg.Workers; i++ {
+		consumer := fmt.Sprintf("%s-%d", p.cfg.Consumer, i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.consume(ctx, consumer)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.reclaim(ctx, p.cfg.Consumer+"-reclaimer")
+	}()
+	wg.Wait()
+	return nil
+}
+
+func (p *Processor) consume(ctx context.Context, consumer string) {
+	for ctx.Err() == nil {
+		streams, err := p.client.XReadGroup(ctx, &goredis.XReadGroupArgs{
+			Group:    p.cfg.Group,
+			Consumer: consumer,
+			Streams:  []string{p.cfg.Stream, ">"},
+			Count:    p.cfg.BatchSize,
+			Block:    p.cfg.Block,
+		}).Result()
+		if errors.Is(err, goredis.Nil) {
+			continue
+		}
+		if err != nil {
+			p.pause(ctx, "reading", err)
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				p.process(ctx, msg, false)
+			}
+		}
+	}
+}
+
+func (p *Processor) reclaim(ctx context.Context, consumer string) {
+	ticker := time.NewTicker(p.cfg.ClaimEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := "0-0"
+		for ctx.Err() == nil {
+			messages, next, err := p.client.XAutoClaim(ctx, &goredis.XAutoClaimArgs{
+				Stream:   p.cfg.Stream,
+				Group:    p.cfg.Group,
+				Consumer: consumer,
+				MinIdle:  p.cfg.ClaimIdle,
+				Start:    start,
+				Count:    p.cfg.BatchSize,
+			}).Result()
+			if err != nil {
+				p.pause(ctx, "reclaiming", err)
+				break
+			}
+			for _, msg := range messages {
+				p.process(ctx, msg, true)
+			}
+			if next == "0-0" {
+				break
+			}
+			start = next
+		}
+	}
+}
+
+// process hands one entry to the handler and acknowledges it on success.
+// Entries that are not valid meter readings go straight to the dead-letter
+// stream; reclaimed entries do too once they reach MaxDeliveries.
+func (p *Processor) process(ctx context.Context, msg goredis.XMessage, reclaimed bool) {
+	reading, err := models.MeterReadingFromStreamMap(msg.Values)
+	if err != nil {
+		p.deadLetter(ctx, msg, err)
+		return
+	}
+
+	if err := p.handle(ctx, models.FeedEntry{ID: msg.ID, Reading: reading}); err != nil {
+		if reclaimed && p.deliveries(ctx, msg.ID) >= p.cfg.MaxDeliveries {
+			p.deadLetter(ctx, msg, err)
+			return
+		}
+		log.Printf("processing %s %s: %v", p.cfg.Stream, msg.ID, err)
+		return
+	}
+
+	pipe := p.client.TxPipeline()
+	p.ack(ctx, pipe, msg.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("acknowledging %s %s: %v", p.cfg.Stream, msg.ID, err)
+	}
+}
+
+// ack queues the acknowledgement of an entry, and its deletion with
+// DeleteOnAck.
+func (p *Processor) ack(ctx context.Context, pipe goredis.Pipeliner, id string) {
+	pipe.XAck(ctx, p.cfg.Stream, p.cfg.Group, id)
+	if p.cfg.DeleteOnAck {
+		pipe.XDel(ctx, p.cfg.Stream, id)
+	}
+}
+
+func (p *Processor) deliveries(ctx context.Context, id string) int64 {
+	pending, err := p.client.XPendingExt(ctx, &goredis.XPendingExtArgs{
+		Stream: p.cfg.Stream,
+		Group:  p.cfg.Group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 0
+	}
+	return pending[0].RetryCount
+}
+
+// deadLetter copies an entry to the dead-letter stream with the reason it
+// failed and its original ID, then acknowledges it in one transaction.
+func (p *Processor) deadLetter(ctx context.Context, msg goredis.XMessage, cause error) {
+	values := make(map[string]interface{}, len(msg.Values)+3)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["source_id"] = msg.ID
+	values["group"] = p.cfg.Group
+	values["error"] = cause.Error()
+
+	pipe := p.client.TxPipeline()
+	pipe.XAdd(ctx, &goredis.XAddArgs{
+		Stream: p.cfg.DeadLetter,
+		MaxLen: DeadLetterMaxLength,
+		Approx: true,
+		Values: values,
+	})
+	p.ack(ctx, pipe, msg.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("dead-lettering %s %s: %v", p.cfg.Stream, msg.ID, err)
+		return
+	}
+	log.Printf("dead-lettered %s %s: %v", p.cfg.Stream, msg.ID, cause)
+}
+
+func (p *Processor) pause(ctx context.Context, what string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	log.Printf("%s %s (group %s): %v", what, p.cfg.Stream, p.cfg.Group, err)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,215 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"redisolar-go/internal/config"
+	"redisolar-go/internal/keyschema"
+	"redisolar-go/internal/models"
+)
+
+const testGroup = "test"
+
+var testReading = models.MeterReading{SiteID: 1, WHUsed: 1.5, WHGenerated: 2.5, TempC: 20, Timestamp: 1577880000}
+
+// testClient connects to the Redis at config.TestRedisAddr, skipping the
+// test if none is set or it is unreachable. Keys with the test prefix are
+// deleted when the test finishes.
+func testClient(t *testing.T) (*goredis.Client, *keyschema.KeySchema) {
+	addr := config.TestRedisAddr()
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR not set")
+	}
+	cfg := config.Load()
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     addr,
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+	})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("Redis not available: %v", err)
+	}
+
+	ks := keyschema.New(keyschema.DefaultKeyPrefix)
+	t.Cleanup(func() {
+		iter := client.Scan(ctx, 0, ks.Prefix+":*", 1000).Iterator()
+		for iter.Next(ctx) {
+			client.Del(ctx, iter.Val())
+		}
+		client.Close()
+	})
+	return client, ks
+}
+
+// start runs a processor on the test ingest stream until the test ends.
+func start(t *testing.T, client *goredis.Client, ks *keyschema.KeySchema, cfg Config, handle Handler) {
+	cfg.Stream = ks.IngestStreamKey()
+	cfg.Group = testGroup
+	cfg.StartID = "0"
+	cfg.Consumer = "tester"
+	cfg.DeadLetter = ks.IngestDeadLetterKey()
+	cfg.Block = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- New(client, cfg, handle).Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	})
+}
+
+func add(t *testing.T, client *goredis.Client, stream string, values map[string]interface{}) string {
+	id, err := client.XAdd(context.Background(), &goredis.XAddArgs{Stream: stream, Values: values}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// eventually fails the test if cond does not hold within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func pending(t *testing.T, client *goredis.Client, stream string) int64 {
+	p, err := client.XPending(context.Background(), stream, testGroup).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Count
+}
+
+func deadLettered(t *testing.T, client *goredis.Client, ks *keyschema.KeySchema) []goredis.XMessage {
+	messages, err := client.XRange(context.Background(), ks.IngestDeadLetterKey(), "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+// recorder is a handler that records the entries it is handed.
+type recorder struct {
+	mu      sync.Mutex
+	entries []models.FeedEntry
+}
+
+func (r *recorder) handle(ctx context.Context, entry models.FeedEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+func (r *recorder) seen() []models.FeedEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]models.FeedEntry(nil), r.entries...)
+}
+
+func TestProcessor_ProcessesAndAcks(t *testing.T) {
+	client, ks := testClient(t)
+	stream := ks.IngestStreamKey()
+	id := add(t, client, stream, models.MeterReadingToStreamMap(testReading))
+
+	rec := &recorder{}
+	start(t, client, ks, Config{DeleteOnAck: true}, rec.handle)
+
+	eventually(t, "the entry to be processed", func() bool { return len(rec.seen()) == 1 })
+	entry := rec.seen()[0]
+	if entry.ID != id || entry.Reading != testReading {
+		t.Errorf("handled %+v, want ID %s and reading %+v", entry, id, testReading)
+	}
+	eventually(t, "the entry to be acknowledged", func() bool { return pending(t, client, stream) == 0 })
+	eventually(t, "the entry to be deleted", func() bool {
+		return client.XLen(context.Background(), stream).Val() == 0
+	})
+}
+
+func TestProcessor_ReclaimsIdleEntries(t *testing.T) {
+	client, ks := testClient(t)
+	ctx := context.Background()
+	stream := ks.IngestStreamKey()
+	id := add(t, client, stream, models.MeterReadingToStreamMap(testReading))
+
+	// A consumer that reads the entry and dies before acknowledging it.
+	if err := client.XGroupCreate(ctx, stream, testGroup, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.XReadGroup(ctx, &goredis.XReadGroupArgs{
+		Group: testGroup, Consumer: "dead", Streams: []string{stream, ">"},
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recorder{}
+	start(t, client, ks, Config{ClaimIdle: 100 * time.Millisecond, ClaimEvery: 50 * time.Millisecond}, rec.handle)
+
+	eventually(t, "the entry to be reclaimed", func() bool { return len(rec.seen()) == 1 })
+	if got := rec.seen()[0].ID; got != id {
+		t.Errorf("reclaimed %s, want %s", got, id)
+	}
+	eventually(t, "the entry to be acknowledged", func() bool { return pending(t, client, stream) == 0 })
+}
+
+func TestProcessor_DeadLettersAfterMaxDeliveries(t *testing.T) {
+	client, ks := testClient(t)
+	stream := ks.IngestStreamKey()
+	id := add(t, client, stream, models.MeterReadingToStreamMap(testReading))
+
+	failure := errors.New("always fails")
+	start(t, client, ks, Config{
+		ClaimIdle:     50 * time.Millisecond,
+		ClaimEvery:    25 * time.Millisecond,
+		MaxDeliveries: 2,
+	}, func(ctx context.Context, entry models.FeedEntry) error {
+		return failure
+	})
+
+	eventually(t, "the entry to be dead-lettered", func() bool { return len(deadLettered(t, client, ks)) == 1 })
+	dead := deadLettered(t, client, ks)[0]
+	if dead.Values["source_id"] != id || dead.Values["group"] != testGroup || dead.Values["error"] != failure.Error() {
+		t.Errorf("dead-lettered %v, want source_id %s, group %s and error %q", dead.Values, id, testGroup, failure)
+	}
+	if got := pending(t, client, stream); got != 0 {
+		t.Errorf("%d entries pending after dead-lettering, want 0", got)
+	}
+}
+
+func TestProcessor_DeadLettersUnparsableEntries(t *testing.T) {
+	client, ks := testClient(t)
+	stream := ks.IngestStreamKey()
+	id := add(t, client, stream, map[string]interface{}{"site_id": "not a number"})
+
+	rec := &recorder{}
+	start(t, client, ks, Config{}, rec.handle)
+
+	eventually(t, "the entry to be dead-lettered", func() bool { return len(deadLettered(t, client, ks)) == 1 })
+	dead := deadLettered(t, client, ks)[0]
+	if dead.Values["source_id"] != id || dead.Values["site_id"] != "not a number" || dead.Values["error"] == "" {
+		t.Errorf("dead-lettered %v, want source_id %s with the original fields and an error", dead.Values, id)
+	}
+	if got := pending(t, client, stream); got != 0 {
+		t.Errorf("%d entries pending after dead-lettering, want 0", got)
+	}
+	if seen := rec.seen(); len(seen) != 0 {
+		t.Errorf("handler was given %d unparsable entries, want 0", len(seen))
+	}
+}
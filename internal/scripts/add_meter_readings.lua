@@ -0,0 +1,215 @@
+-- Redis script to ingest a batch of meter readings in one atomic step:
+-- metrics, capacity ranking and average, hourly and daily capacity sums
+-- and counts, global and site feeds and daily stats.
+--
+-- KEYS[1]: capacity ranking sorted set
+-- KEYS[2]: global feed stream
+-- KEYS[3]: capacity moving average sorted set
+-- KEYS[4]: stats queue stream, used instead of the stats hashes when stats
+-- are not updated here
+-- then, per reading, 10 keys: whG, whU and tempC metrics (timeseries, or
+-- the day's sorted sets), site feed stream, site stats hash, dedupe
+-- marker, hourly and daily capacity sum sorted sets, and hourly and daily
+-- capacity count sorted sets.
+--
+-- ARGV[1..12]: retention ms, global feed max length, site feed max length,
+-- stats TTL seconds, reporting time, dedupe marker TTL seconds, whether to
+-- update stats (1 or 0), weight of a reading in the moving average, hourly
+-- and daily capacity TTL seconds, whether metrics are timeseries (1) or
+-- sorted sets (0), sorted set metric TTL seconds
+-- then, per reading, 8 values: site_id, wh_used, wh_generated, temp_c,
+-- timestamp, timestamp in ms, current capacity, minute of the day.
+--
+-- Readings whose dedupe marker already exists are skipped. Returns one
+-- flag per reading: 1 if it was written, 0 if it was a duplicate.
+--
+-- Redis does not roll back a script that fails part way, so every key is
+-- checked before the first write: each must be missing or of the type it
+-- is written as, and a timeseries must still retain the reading's
+-- timestamp. The script fails with nothing written if any check does.
+
+local GLOBAL_KEYS = 4
+local GLOBAL_ARGS = 12
+local KEYS_PER_READING = 10
+local ARGS_PER_READING = 8
+
+local ranking_key = KEYS[1]
+local global_feed_key = KEYS[2]
+local average_key = KEYS[3]
+local stats_queue_key = KEYS[4]
+
+local retention = ARGV[1]
+local global_max_len = ARGV[2]
+local site_max_len = ARGV[3]
+local stats_ttl = ARGV[4]
+local reporting_time = ARGV[5]
+local dedupe_ttl = ARGV[6]
+local update_stats = ARGV[7] == '1'
+local alpha = tonumber(ARGV[8])
+local hour_ttl = ARGV[9]
+local day_ttl = ARGV[10]
+local timeseries = ARGV[11] == '1'
+local metric_ttl = ARGV[12]
+
+local count = (#ARGV - GLOBAL_ARGS) / ARGS_PER_READING
+
+-- A dedupe marker may already exist, or belong to an earlier reading of
+-- this same batch.
+local written = {}
+local seen = {}
+for i = 0, count - 1 do
+  local dedupe_key = KEYS[GLOBAL_KEYS + i * KEYS_PER_READING + 6]
+  if seen[dedupe_key] or redis.call('exists', dedupe_key) == 1 then
+    written[i + 1] = 0
+  else
+    written[i + 1] = 1
+    seen[dedupe_key] = true
+  end
+end
+
+local function check_type(key, want)
+  local got = redis.call('type', key)['ok']
+  if got ~= 'none' and got ~= want then
+    return 'WRONGTYPE ' .. key .. ' is a ' .. got .. ', not a ' .. want
+  end
+end
+
+-- check_retention fails if TS.ADD would reject time_ms as older than the
+-- series' retention allows.
+local function check_retention(key, time_ms)
+  if redis.call('exists', key) == 0 then
+    return nil
+  end
+  local info = redis.call('TS.INFO', key)
+  local fields = {}
+  for j = 1, #info - 1, 2 do
+    fields[info[j]] = info[j + 1]
+  end
+  local keep = tonumber(fields['retentionTime']) or 0
+  local last = tonumber(fields['lastTimestamp']) or 0
+  if keep > 0 and last - tonumber(time_ms) > keep then
+    return 'TSDB: timestamp ' .. time_ms .. ' of ' .. key .. ' is older than its retention'
+  end
+end
+
+local function check()
+  local err = check_type(ranking_key, 'zset') or
+    check_type(global_feed_key, 'stream') or
+    check_type(average_key, 'zset') or
+    check_type(stats_queue_key, 'stream')
+  if err then
+    return err
+  end
+  for i = 0, count - 1 do
+    if written[i + 1] == 1 then
+      local k = GLOBAL_KEYS + i * KEYS_PER_READING
+      local a = GLOBAL_ARGS + i * ARGS_PER_READING
+      for j = 1, 3 do
+        if timeseries then
+          err = check_type(KEYS[k + j], 'TSDB-TYPE') or
+            check_retention(KEYS[k + j], ARGV[a + 6])
+        else
+          err = check_type(KEYS[k + j], 'zset')
+        end
+        if err then
+          return err
+        end
+      end
+      err = check_type(KEYS[k + 4], 'stream') or
+        check_type(KEYS[k + 5], 'hash') or
+        check_type(KEYS[k + 7], 'zset') or
+        check_type(KEYS[k + 8], 'zset') or
+        check_type(KEYS[k + 9], 'zset') or
+        check_type(KEYS[k + 10], 'zset')
+      if err then
+        return err
+      end
+    end
+  end
+end
+
+local err = check()
+if err then
+  return redis.error_reply(err)
+end
+
+local function update_if(key, field, value, op)
+  local current = redis.call('hget', key, field)
+  if (current == false or current == nil) or
+     (op == '>' and tonumber(value) > tonumber(current)) or
+     (op == '<' and tonumber(value) < tonumber(current)) then
+    redis.call('hset', key, field, value)
+  end
+end
+
+for i = 0, count - 1 do
+  if written[i + 1] == 1 then
+    local k = GLOBAL_KEYS + i * KEYS_PER_READING
+    local a = GLOBAL_ARGS + i * ARGS_PER_READING
+    local values = {ARGV[a + 3], ARGV[a + 2], ARGV[a + 4]}
+    for j = 1, 3 do
+      if timeseries then
+        redis.call('TS.ADD', KEYS[k + j], ARGV[a + 6], values[j],
+          'RETENTION', retention, 'ON_DUPLICATE', 'LAST')
+      else
+        local minute = tonumber(ARGV[a + 8])
+        redis.call('zadd', KEYS[k + j], minute,
+          string.format('%.2f:%d', tonumber(values[j]), minute))
+        redis.call('expire', KEYS[k + j], metric_ttl)
+      end
+    end
+  end
+end
+
+for i = 0, count - 1 do
+  if written[i + 1] == 1 then
+    local k = GLOBAL_KEYS + i * KEYS_PER_READING
+    local a = GLOBAL_ARGS + i * ARGS_PER_READING
+    local site_id = ARGV[a + 1]
+    local wh_used = ARGV[a + 2]
+    local wh_generated = ARGV[a + 3]
+    local capacity = ARGV[a + 7]
+    local fields = {
+      'site_id', site_id,
+      'wh_used', wh_used,
+      'wh_generated', wh_generated,
+      'temp_c', ARGV[a + 4],
+      'timestamp', ARGV[a + 5],
+    }
+
+    redis.call('zadd', ranking_key, capacity, site_id)
+    local average = redis.call('zscore', average_key, site_id)
+    if average then
+      redis.call('zadd', average_key,
+        alpha * tonumber(capacity) + (1 - alpha) * tonumber(average), site_id)
+    else
+      redis.call('zadd', average_key, capacity, site_id)
+    end
+    redis.call('zincrby', KEYS[k + 7], capacity, site_id)
+    redis.call('expire', KEYS[k + 7], hour_ttl)
+    redis.call('zincrby', KEYS[k + 9], 1, site_id)
+    redis.call('expire', KEYS[k + 9], hour_ttl)
+    redis.call('zincrby', KEYS[k + 8], capacity, site_id)
+    redis.call('expire', KEYS[k + 8], day_ttl)
+    redis.call('zincrby', KEYS[k + 10], 1, site_id)
+    redis.call('expire', KEYS[k + 10], day_ttl)
+    redis.call('xadd', global_feed_key, 'MAXLEN', '~', global_max_len, '*', unpack(fields))
+    redis.call('xadd', KEYS[k + 4], 'MAXLEN', '~', site_max_len, '*', unpack(fields))
+
+    if update_stats then
+      local stats_key = KEYS[k + 5]
+      redis.call('hset', stats_key, 'last_reporting_time', reporting_time)
+      redis.call('hincrby', stats_key, 'meter_reading_count', 1)
+      redis.call('expire', stats_key, stats_ttl)
+      update_if(stats_key, 'max_wh_generated', wh_generated, '>')
+      update_if(stats_key, 'min_wh_generated', wh_generated, '<')
+      update_if(stats_key, 'max_capacity', capacity, '>')
+    else
+      redis.call('xadd', stats_queue_key, '*', unpack(fields))
+    end
+
+    redis.call('set', KEYS[k + 6], 1, 'EX', dedupe_ttl)
+  end
+end
+
+return written
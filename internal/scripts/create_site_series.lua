@@ -0,0 +1,58 @@
+-- Redis script to create a site's timeseries, each with an hourly and a
+-- daily compaction, or to refresh the labels of those that already exist.
+--
+-- KEYS: per unit, 3 keys: raw, hourly and daily timeseries
+-- ARGV[1..6]: raw, hourly and daily retention ms, hour and day bucket ms,
+-- compaction aggregation
+-- then one unit name per unit, then label name/value pairs shared by every
+-- series. Each series is also labelled with its unit and bucket (raw, hour
+-- or day).
+--
+-- A compaction rule is only created along with its destination series, so
+-- running the script again never adds a second rule.
+
+local GLOBAL_ARGS = 6
+local KEYS_PER_UNIT = 3
+
+local raw_retention = ARGV[1]
+local hour_retention = ARGV[2]
+local day_retention = ARGV[3]
+local hour_ms = ARGV[4]
+local day_ms = ARGV[5]
+local aggregation = ARGV[6]
+
+local count = #KEYS / KEYS_PER_UNIT
+
+local function labels(unit, bucket)
+  local l = {'LABELS', 'unit', unit, 'bucket', bucket}
+  for i = GLOBAL_ARGS + count + 1, #ARGV do
+    l[#l + 1] = ARGV[i]
+  end
+  return l
+end
+
+-- Returns true if the series was created, false if it only got new labels.
+local function ensure(key, retention, unit, bucket)
+  if redis.call('exists', key) == 1 then
+    redis.call('TS.ALTER', key, unpack(labels(unit, bucket)))
+    return false
+  end
+  redis.call('TS.CREATE', key, 'RETENTION', retention,
+    'DUPLICATE_POLICY', 'LAST', unpack(labels(unit, bucket)))
+  return true
+end
+
+for i = 0, count - 1 do
+  local raw_key = KEYS[i * KEYS_PER_UNIT + 1]
+  local hour_key = KEYS[i * KEYS_PER_UNIT + 2]
+  local day_key = KEYS[i * KEYS_PER_UNIT + 3]
+  local unit = ARGV[GLOBAL_ARGS + i + 1]
+
+  ensure(raw_key, raw_retention, unit, 'raw')
+  if ensure(hour_key, hour_retention, unit, 'hour') then
+    redis.call('TS.CREATERULE', raw_key, hour_key, 'AGGREGATION', aggregation, hour_ms)
+  end
+  if ensure(day_key, day_retention, unit, 'day') then
+    redis.call('TS.CREATERULE', raw_key, day_key, 'AGGREGATION', aggregation, day_ms)
+  end
+end
@@ -14,8 +14,29 @@ var compareAndUpdateLua string
 //go:embed update_if_lowest.lua
 var updateIfLowestLua string
 
+//go:embed add_meter_readings.lua
+var addMeterReadingsLua string
+
+//go:embed update_capacity_average.lua
+var updateCapacityAverageLua string
+
+//go:embed create_site_series.lua
+var createSiteSeriesLua string
+
 var CompareAndUpdateScript = redis.NewScript(compareAndUpdateLua)
 var UpdateIfLowestScript = redis.NewScript(updateIfLowestLua)
+var AddMeterReadingsScript = redis.NewScript(addMeterReadingsLua)
+var UpdateCapacityAverageScript = redis.NewScript(updateCapacityAverageLua)
+var CreateSiteSeriesScript = redis.NewScript(createSiteSeriesLua)
+
+// Preload queues SCRIPT LOAD for the scripts that DAOs run with EVALSHA on a
+// pipeline. Inside a pipeline the NOSCRIPT fallback in Script.Run cannot
+// kick in, so the script must already be cached when the EVALSHA executes.
+func Preload(ctx context.Context, pipe redis.Pipeliner) {
+	CompareAndUpdateScript.Load(ctx, pipe)
+	UpdateCapacityAverageScript.Load(ctx, pipe)
+	CreateSiteSeriesScript.Load(ctx, pipe)
+}
 
 // UpdateIfGreater runs the compare_and_update Lua script with ">" operator.
 func UpdateIfGreater(ctx context.Context, client redis.Scripter, key, field string, value float64) *redis.Cmd {
@@ -26,3 +47,9 @@ func UpdateIfGreater(ctx context.Context, client redis.Scripter, key, field stri
 func UpdateIfLess(ctx context.Context, client redis.Scripter, key, field string, value float64) *redis.Cmd {
 	return CompareAndUpdateScript.Run(ctx, client, []string{key}, field, fmt.Sprintf("%v", value), "<")
 }
+
+// UpdateCapacityAverage runs the update_capacity_average Lua script, moving
+// a site's average capacity towards capacity by weight alpha.
+func UpdateCapacityAverage(ctx context.Context, client redis.Scripter, key string, siteID int, capacity, alpha float64) *redis.Cmd {
+	return UpdateCapacityAverageScript.Run(ctx, client, []string{key}, siteID, capacity, alpha)
+}
@@ -0,0 +1,19 @@
+-- Redis script to fold a site's current capacity into its exponentially
+-- weighted moving average, kept in a sorted set scored by the average.
+--
+-- KEYS[1]: capacity average sorted set
+-- ARGV[1]: site_id
+-- ARGV[2]: current capacity
+-- ARGV[3]: weight of the current capacity, between 0 and 1
+
+local key = KEYS[1]
+local site_id = ARGV[1]
+local capacity = tonumber(ARGV[2])
+local alpha = tonumber(ARGV[3])
+
+local average = redis.call('zscore', key, site_id)
+if average then
+  capacity = alpha * capacity + (1 - alpha) * tonumber(average)
+end
+
+redis.call('zadd', key, capacity, site_id)